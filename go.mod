@@ -13,7 +13,6 @@ require (
 	github.com/muesli/mango-cobra v1.2.0
 	github.com/muesli/roff v0.1.0
 	github.com/otiai10/copy v1.14.0
-	github.com/riywo/loginshell v0.0.0-20200815045211-7d26008be1ab
 	github.com/samber/lo v1.39.0
 	github.com/spf13/cobra v1.8.0
 	gopkg.in/yaml.v3 v3.0.1
@@ -16,6 +16,8 @@ import (
 
 type PackageCache struct {
 	location string
+	// fresh is set when the cache was just refreshed
+	fresh    bool
 	Packages PackageList
 }
 
@@ -66,6 +68,7 @@ func New() (*PackageCache, error) {
 		if err != nil {
 			return pc, err
 		}
+		pc.fresh = true
 	}
 	return pc, nil
 }
@@ -102,8 +105,11 @@ func (pc *PackageCache) Update() error {
 }
 
 func (pc *PackageCache) packageIndex() ([]byte, error) {
+	if fleek.OfflineMode {
+		return nil, fleek.ErrOfflineMode
+	}
 	args := []string{"search", "nixpkgs", "--json", "^"}
-	cmd, buf := cmdutil.CommandTTYWithBufferNoOut("nix", args...)
+	cmd, buf := cmdutil.CommandTTYWithBufferNoOut(fleek.NixBinary(), args...)
 	cmd.Env = os.Environ()
 	// nix search nixpkgs --json
 	err := cmd.Run()
@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+// IndexTTL is how long CachedPackageIndex uses the package
+// cache before it is refreshed from `nix search`.
+var IndexTTL = 7 * 24 * time.Hour
+
+// Names returns the sorted, unique package names in the cache.
+func (pc *PackageCache) Names() []string {
+	names := make([]string, 0, len(pc.Packages))
+	seen := make(map[string]bool, len(pc.Packages))
+	for _, p := range pc.Packages {
+		if p.Name == "" || seen[p.Name] {
+			continue
+		}
+		seen[p.Name] = true
+		names = append(names, p.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// stale reports whether the package cache is older than IndexTTL.
+func (pc *PackageCache) stale() bool {
+	info, err := os.Stat(pc.cacheFile())
+	if err != nil {
+		return true
+	}
+	return time.Since(info.ModTime()) >= IndexTTL
+}
+
+// BuildPackageIndex refreshes the package cache from
+// `nix search` and returns the available package names.
+func BuildPackageIndex() ([]string, error) {
+	pc, err := New()
+	if err != nil {
+		return nil, err
+	}
+	// New just refreshed a missing cache
+	if !pc.fresh {
+		err = pc.Update()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pc.Names(), nil
+}
+
+// CachedPackageIndex returns the available package names
+// from the package cache, refreshing it when it is older
+// than IndexTTL.
+func CachedPackageIndex() ([]string, error) {
+	pc, err := New()
+	if err != nil {
+		return nil, err
+	}
+	if !pc.fresh && pc.stale() {
+		err = pc.Update()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pc.Names(), nil
+}
@@ -5,6 +5,7 @@ package cmdutil
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"os"
 	"os/exec"
@@ -18,6 +19,16 @@ func CommandTTY(name string, arg ...string) *exec.Cmd {
 	return cmd
 }
 
+// CommandTTYContext is like CommandTTY but the command
+// is killed when ctx is done.
+func CommandTTYContext(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, arg...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
 // CommandTTYWithBuffer returns a command with stdin, stdout, and stderr
 // and a buffer that contains stdout and stderr combined.
 func CommandTTYWithBuffer(
@@ -11,6 +11,10 @@ const (
 
 	SSHTTY = "SSH_TTY"
 
+	NixBin = "FLEEK_NIX_BIN"
+
+	ConfigPath = "FLEEK_CONFIG"
+
 	XDGDataHome   = "XDG_DATA_HOME"
 	XDGConfigHome = "XDG_CONFIG_HOME"
 	XDGCacheHome  = "XDG_CACHE_HOME"
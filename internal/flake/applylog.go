@@ -0,0 +1,84 @@
+package flake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ublue-os/fleek/internal/fleek"
+)
+
+var ErrRemoteApply = errors.New("only the local system can be applied")
+
+// logEnv are the environment variables written to the
+// apply log, along with every FLEEK_ variable.
+var logEnv = []string{"HOME", "USER", "SHELL", "NIX_PATH", "NIX_CONFIG", "NIXPKGS_ALLOW_UNFREE"}
+
+// ApplyLogged is like Apply but the output of the switch is
+// also written to the file at logPath, along with each
+// command line, the relevant environment and timestamps.
+// The log is appended to, unless rotate is set, in which
+// case an existing log is first moved to logPath.1. Like
+// Rollback, system must be empty or the local hostname.
+func (f *Flake) ApplyLogged(system, logPath string, rotate bool) error {
+	host, err := fleek.Hostname()
+	if err != nil {
+		return err
+	}
+	if system != "" && !fleek.SameHost(system, host) {
+		return fmt.Errorf("%w: %s", ErrRemoteApply, system)
+	}
+	if rotate && fleek.Exists(logPath) {
+		err = os.Rename(logPath, logPath+".1")
+		if err != nil {
+			return err
+		}
+	}
+	log, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+	writeLogHeader(log, host, f.Config.UserFlakeDir(), f.Config.Unfree)
+	err = f.applyContext(context.Background(), log)
+	status := "ok"
+	if err != nil {
+		status = err.Error()
+	}
+	fmt.Fprintf(log, "==== finished %s: %s\n\n", time.Now().Format(time.RFC3339), status)
+	return err
+}
+
+func writeLogHeader(w io.Writer, host, dir string, unfree bool) {
+	fmt.Fprintf(w, "==== fleek apply %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "host: %s\n", host)
+	fmt.Fprintf(w, "directory: %s\n", dir)
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, "FLEEK_") || isLoggedEnv(name) {
+			env = append(env, kv)
+		}
+	}
+	if unfree {
+		env = append(env, "NIXPKGS_ALLOW_UNFREE=1")
+	}
+	sort.Strings(env)
+	for _, kv := range env {
+		fmt.Fprintf(w, "env: %s\n", kv)
+	}
+}
+
+func isLoggedEnv(name string) bool {
+	for _, e := range logEnv {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
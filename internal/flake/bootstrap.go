@@ -0,0 +1,91 @@
+package flake
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/ublue-os/fleek/fin"
+	"github.com/ublue-os/fleek/internal/fleek"
+)
+
+// Bootstrap sets up fleek on a new machine in one step.
+// It clones repo into the flake directory, or creates a
+// new configuration if repo is empty, registers the local
+// system, writes the flake and applies it. The git user
+// comes from DetectUser, with name and email replacing the
+// detected ones when they aren't empty, so nothing is
+// prompted for. Running it again on a machine that is
+// already set up skips the clone and doesn't add the
+// system twice.
+func (f *Flake) Bootstrap(repo, name, email string) error {
+	user, err := fleek.DetectUser()
+	if err != nil {
+		return err
+	}
+	if name != "" {
+		user.Name = name
+	}
+	if email != "" {
+		user.Email = email
+	}
+	dir := f.Config.UserFlakeDir()
+	if !fleek.Exists(filepath.Join(dir, ".fleek.yml")) {
+		if repo == "" {
+			fin.Logger.Debug("bootstrap: creating configuration", fin.Logger.Args("dir", dir))
+			err := f.create(user, false, true)
+			if err != nil {
+				return err
+			}
+			return f.Apply()
+		}
+		fin.Logger.Debug("bootstrap: cloning", fin.Logger.Args("repo", repo, "dir", dir))
+		err := f.Clone(repo)
+		if err != nil {
+			return err
+		}
+	}
+	config, err := fleek.ReadConfig(dir)
+	if err != nil {
+		return err
+	}
+	err = registerSystem(config, user)
+	if err != nil {
+		return err
+	}
+	if _, override := fleek.ConfigOverride(); !override {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		loc, err := config.Location()
+		if err != nil {
+			return err
+		}
+		err = fleek.ForceSymlink(loc, filepath.Join(home, ".fleek.yml"))
+		if err != nil {
+			return err
+		}
+	}
+	f.Config = config
+	err = f.Write("join new system", true, true)
+	if err != nil {
+		return err
+	}
+	return f.Apply()
+}
+
+// registerSystem adds the local system with user to config
+// and saves it, unless it's already registered.
+func registerSystem(config *fleek.Config, user *fleek.User) error {
+	if _, err := config.CurrentSystem(); err == nil {
+		return nil
+	}
+	fin.Logger.Debug("registering system")
+	sys, err := fleek.NewSystem()
+	if err != nil {
+		return err
+	}
+	sys.User = user
+	config.Systems = append(config.Systems, sys)
+	return config.Save()
+}
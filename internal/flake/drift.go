@@ -0,0 +1,79 @@
+package flake
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// GeneratedDrift renders the flake to a temporary directory
+// and compares the generated files with those in the flake
+// directory. It reports whether any differ and a diff of the
+// changes a write would make, using `diff -u` when it is
+// installed. Ejected configurations are never compared.
+func (f *Flake) GeneratedDrift() (bool, string, error) {
+	if f.Config.Ejected {
+		return false, "", nil
+	}
+	tmp, err := os.MkdirTemp("", "fleek-drift*")
+	if err != nil {
+		return false, "", err
+	}
+	defer os.RemoveAll(tmp)
+	err = f.RenderTo(tmp)
+	if err != nil {
+		return false, "", err
+	}
+	var diff strings.Builder
+	var drift bool
+	for _, name := range f.Config.GeneratedFiles() {
+		current := filepath.Join(f.Config.UserFlakeDir(), name)
+		generated := filepath.Join(tmp, name)
+		same, err := sameContents(current, generated)
+		if err != nil {
+			return false, "", err
+		}
+		if same {
+			continue
+		}
+		drift = true
+		diff.WriteString(fileDiff(current, generated, name))
+	}
+	return drift, diff.String(), nil
+}
+
+// sameContents reports whether the files at a and b hold
+// the same bytes. A missing file never matches.
+func sameContents(a, b string) (bool, error) {
+	ab, err := os.ReadFile(a)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	bb, err := os.ReadFile(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(ab, bb), nil
+}
+
+// fileDiff returns a unified diff from current to generated,
+// or a one line summary if diff isn't available.
+func fileDiff(current, generated, name string) string {
+	if _, err := exec.LookPath("diff"); err != nil {
+		return fmt.Sprintf("%s differs from the generated file\n", name)
+	}
+	// diff exits 1 when the files differ
+	out, _ := exec.Command("diff", "-u", "--label", "a/"+name, "--label", "b/"+name, current, generated).Output()
+	if len(out) == 0 {
+		return fmt.Sprintf("%s is missing\n", name)
+	}
+	return string(out)
+}
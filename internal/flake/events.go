@@ -0,0 +1,136 @@
+package flake
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Event is a progress event written as one line of JSON
+// by the ...Events variants of long-running operations.
+// Status is started, output, finished or failed. Output
+// events carry one line of command output in Message.
+type Event struct {
+	Phase   string    `json:"phase"`
+	Status  string    `json:"status"`
+	Message string    `json:"message,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// eventStream writes events for a single phase to w.
+type eventStream struct {
+	mu    sync.Mutex
+	w     io.Writer
+	phase string
+}
+
+func (s *eventStream) emit(status, message string, err error) {
+	e := Event{Phase: s.phase, Status: status, Message: message, Time: time.Now()}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	bb, _ := json.Marshal(e)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _ = s.w.Write(append(bb, '\n'))
+}
+
+// lineWriter turns command output into an
+// output event for each line. It's shared by stdout and
+// stderr, which exec.Cmd may copy from two goroutines.
+type lineWriter struct {
+	events *eventStream
+	mu     sync.Mutex
+	buf    []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		l.events.emit("output", string(bytes.TrimRight(l.buf[:i], "\r")), nil)
+		l.buf = l.buf[i+1:]
+	}
+}
+
+func (l *lineWriter) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buf) > 0 {
+		l.events.emit("output", string(l.buf), nil)
+		l.buf = nil
+	}
+}
+
+// withEvents runs fn with the output of the commands it
+// runs sent to w as events for phase instead of the
+// terminal, surrounded by started and finished or
+// failed events.
+func (f *Flake) withEvents(w io.Writer, phase string, fn func() error) error {
+	f.events = &eventStream{w: w, phase: phase}
+	defer func() { f.events = nil }()
+	f.events.emit("started", "", nil)
+	err := fn()
+	if err != nil {
+		f.events.emit("failed", "", err)
+		return err
+	}
+	f.events.emit("finished", "", nil)
+	return nil
+}
+
+// eventOutput returns a writer sending command output to
+// the event stream and a function that flushes its partial
+// last line, or a nil writer when there is no stream.
+func (f *Flake) eventOutput() (io.Writer, func()) {
+	if f.events == nil {
+		return nil, func() {}
+	}
+	out := &lineWriter{events: f.events}
+	return out, out.flush
+}
+
+// redirect is like eventOutput, pointing the output
+// of command at the event stream if there is one.
+func (f *Flake) redirect(command *exec.Cmd) func() {
+	out, flush := f.eventOutput()
+	if out != nil {
+		command.Stdout = out
+		command.Stderr = out
+	}
+	return flush
+}
+
+// CloneEvents is like Clone but writes progress to
+// events as newline-delimited JSON, see Event.
+func (f *Flake) CloneEvents(repo string, events io.Writer) error {
+	return f.withEvents(events, "clone", func() error {
+		return f.Clone(repo)
+	})
+}
+
+// ApplyEvents is like Apply but writes progress to
+// events as newline-delimited JSON, see Event.
+func (f *Flake) ApplyEvents(events io.Writer) error {
+	return f.withEvents(events, "apply", func() error {
+		return f.ApplyContext(context.Background())
+	})
+}
+
+// UpdateInputsEvents is like UpdateInputs but writes
+// progress to events as newline-delimited JSON, see Event.
+func (f *Flake) UpdateInputsEvents(events io.Writer, inputs ...string) error {
+	return f.withEvents(events, "update", func() error {
+		return f.UpdateInputs(inputs...)
+	})
+}
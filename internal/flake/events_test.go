@@ -0,0 +1,43 @@
+package flake
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestRedirectBothStreams(t *testing.T) {
+	var out bytes.Buffer
+	f := &Flake{events: &eventStream{w: &out, phase: "test"}}
+	command := exec.Command("sh", "-c", "i=0; while [ $i -lt 200 ]; do echo out $i; echo err $i >&2; i=$((i+1)); done")
+	flush := f.redirect(command)
+	// like runNixContextOutput, so the streams are copied
+	// by separate goroutines
+	var stderr bytes.Buffer
+	command.Stderr = io.MultiWriter(command.Stderr, &stderr)
+	err := command.Run()
+	flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines int
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var e Event
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			t.Fatalf("redirect: invalid event %q: %v", scanner.Text(), err)
+		}
+		if e.Status != "output" || e.Phase != "test" || !(strings.HasPrefix(e.Message, "out ") || strings.HasPrefix(e.Message, "err ")) {
+			t.Fatalf("redirect: unexpected event %+v", e)
+		}
+		lines++
+	}
+	if lines != 400 {
+		t.Fatalf("redirect: expected 400 output events, got %d", lines)
+	}
+}
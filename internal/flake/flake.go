@@ -1,15 +1,18 @@
 package flake
 
 import (
+	"bytes"
+	"context"
 	"embed"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"text/template"
 
-	"github.com/riywo/loginshell"
 	app "github.com/ublue-os/fleek"
 	"github.com/ublue-os/fleek/fin"
 	"github.com/ublue-os/fleek/internal/cmdutil"
@@ -17,14 +20,23 @@ import (
 	"github.com/ublue-os/fleek/internal/fleek"
 )
 
-const nixbin = "nix"
-
 var ErrPackageConflict = errors.New("package exists in fleek and nix profile")
+var ErrNotFlake = errors.New("flake.nix not found in the flake directory")
+var ErrImpureRequired = errors.New("configuration can't be evaluated in pure mode, set `allow_impure: true` in fleek.yml to apply it with --impure")
+
+// pureEvalError is part of the error nix reports when
+// a pure evaluation reads from outside the flake.
+const pureEvalError = "in pure evaluation mode"
 
 type Flake struct {
 	Templates map[string]*template.Template
 	Config    *fleek.Config
 	app       *app.App
+	// dir overrides the output directory, set by RenderTo
+	dir string
+	// events receives command output during an
+	// ...Events call, see withEvents
+	events *eventStream
 }
 type Data struct {
 	Config   *fleek.Config
@@ -66,10 +78,30 @@ func Load(cfg *fleek.Config, app *app.App) (*Flake, error) {
 }
 
 func (f *Flake) Update() error {
+	return f.UpdateContext(context.Background())
+}
+
+// UpdateContext is like Update but the nix command
+// is cancelled when ctx is done.
+func (f *Flake) UpdateContext(ctx context.Context) error {
+	return f.updateInputsContext(ctx)
+}
+
+// UpdateInputs runs `nix flake update` for the named
+// inputs, or every input if none are named, and commits
+// the new flake.lock.
+func (f *Flake) UpdateInputs(inputs ...string) error {
+	return f.updateInputsContext(context.Background(), inputs...)
+}
+
+func (f *Flake) updateInputsContext(ctx context.Context, inputs ...string) error {
+	if !fleek.Exists(filepath.Join(f.Config.UserFlakeDir(), "flake.nix")) {
+		return ErrNotFlake
+	}
 	fin.Logger.Info(f.app.Trans("flake.update"))
 
-	updateCmdLine := []string{"flake", "update"}
-	err := f.runNix(nixbin, updateCmdLine)
+	updateCmdLine := append([]string{"flake", "update"}, inputs...)
+	err := f.runNixContext(ctx, fleek.NixBinary(), updateCmdLine)
 
 	if err != nil {
 		return err
@@ -82,41 +114,29 @@ func (f *Flake) Update() error {
 	return nil
 }
 func (f *Flake) Create(force bool, symlink bool) error {
+	return f.create(nil, force, symlink)
+}
+
+// create is Create registering the local system with
+// user, or a user prompted for if it's nil.
+func (f *Flake) create(user *fleek.User, force bool, symlink bool) error {
 	fin.Logger.Info(f.app.Trans("init.writingConfigs"))
 	err := f.ensureFlakeDir()
 	if err != nil {
 		return err
 	}
-	fullShell, err := loginshell.Shell()
-	if err != nil {
-		return err
-	}
-	shell := filepath.Base(fullShell)
-	f.Config.Shell = shell
+	f.Config.Shell = fleek.DetectShell()
 	err = f.Config.Validate()
 	if err != nil {
 		return err
 	}
-	var bling *fleek.Bling
-
-	switch f.Config.Bling {
-	case "high":
-		bling, err = fleek.HighBling()
-	case "default":
-		bling, err = fleek.DefaultBling()
-	case "low":
-		bling, err = fleek.LowBling()
-	case "none":
-		bling, err = fleek.NoBling()
-	default:
-		bling, err = fleek.DefaultBling()
-	}
+	bling, err := f.Config.CurrentBling()
 	if err != nil {
 		return err
 	}
 
 	fin.Logger.Info("", fin.Logger.Args(f.app.Trans("init.blingLevel"), f.Config.Bling))
-	err = f.Config.WriteInitialConfig(force, symlink)
+	err = f.Config.WriteInitialConfigFor(user, force, symlink)
 	if err != nil {
 		return err
 	}
@@ -132,38 +152,13 @@ func (f *Flake) Create(force bool, symlink bool) error {
 		return err
 	}
 	//user := f.Config.UserForSystem(sys.Hostname)
-	user := sys.User
+	user = sys.User
 	data := Data{
 		Config: f.Config,
 		Bling:  bling,
 	}
 
-	err = f.writeFile("templates/flake.nix.tmpl", "flake.nix", data, force)
-	if err != nil {
-		return err
-	}
-	err = f.writeFile("templates/README.md.tmpl", "README.md", data, force)
-	if err != nil {
-		return err
-	}
-
-	err = f.writeFile("templates/home.nix.tmpl", "home.nix", data, force)
-	if err != nil {
-		return err
-	}
-	err = f.writeFile("templates/aliases.nix.tmpl", "aliases.nix", data, force)
-	if err != nil {
-		return err
-	}
-	err = f.writeFile("templates/path.nix.tmpl", "path.nix", data, force)
-	if err != nil {
-		return err
-	}
-	err = f.writeFile("templates/programs.nix.tmpl", "programs.nix", data, force)
-	if err != nil {
-		return err
-	}
-	err = f.writeFile("templates/shell.nix.tmpl", "shell.nix", data, force)
+	err = f.writeShared(data, force)
 	if err != nil {
 		return err
 	}
@@ -219,8 +214,12 @@ func (f *Flake) Join() error {
 		return err
 	}
 	csym := filepath.Join(home, ".fleek.yml")
-	// ignore if it exists, could have been created by caller
-	_ = os.Symlink(cfile, csym)
+	if _, override := fleek.ConfigOverride(); !override {
+		err = fleek.ForceSymlink(cfile, csym)
+		if err != nil {
+			return err
+		}
+	}
 
 	err = f.Config.Validate()
 	if err != nil {
@@ -300,8 +299,14 @@ func (f *Flake) Join() error {
 }
 
 func (f *Flake) Check() error {
+	return f.CheckContext(context.Background())
+}
+
+// CheckContext is like Check but the nix command
+// is cancelled when ctx is done.
+func (f *Flake) CheckContext(ctx context.Context) error {
 	checkCmdLine := []string{"run", "--impure", "home-manager/master", "build", "--impure", "--", "--flake", "."}
-	err := f.runNix(nixbin, checkCmdLine)
+	err := f.runNixContext(ctx, fleek.NixBinary(), checkCmdLine)
 
 	if err != nil {
 		return err
@@ -317,19 +322,7 @@ func (f *Flake) Write(message string, writeHost, writeUser bool) error {
 		return err
 	}
 
-	var bling *fleek.Bling
-	switch f.Config.Bling {
-	case "high":
-		bling, err = fleek.HighBling()
-	case "default":
-		bling, err = fleek.DefaultBling()
-	case "low":
-		bling, err = fleek.LowBling()
-	case "none":
-		bling, err = fleek.NoBling()
-	default:
-		bling, err = fleek.DefaultBling()
-	}
+	bling, err := f.Config.CurrentBling()
 	if err != nil {
 		return err
 	}
@@ -343,68 +336,112 @@ func (f *Flake) Write(message string, writeHost, writeUser bool) error {
 	if err != nil {
 		return err
 	}
-	err = f.writeFile("templates/flake.nix.tmpl", "flake.nix", data, force)
+	err = f.writeShared(data, force)
 	if err != nil {
 		return err
 	}
-	err = f.writeFile("templates/README.md.tmpl", "README.md", data, force)
+	sys, err := f.Config.CurrentSystem()
 	if err != nil {
 		return err
 	}
-	err = f.writeFile("templates/.gitignore.tmpl", ".gitignore", data, force)
+	if writeHost {
+
+		err = f.writeSystem(sys, "templates/host.nix.tmpl", force)
+		if err != nil {
+			return err
+		}
+	}
+	if writeUser {
+
+		//user := f.Config.UserForSystem(sys.Hostname)
+		user := sys.User
+		err = f.writeUser(*sys, *user, "templates/user.nix.tmpl", true)
+		if err != nil {
+			return err
+		}
+	}
+
+	spinner.Success()
+	err = f.mayCommit(message)
+
 	if err != nil {
 		return err
 	}
+	return nil
 
-	err = f.writeFile("templates/home.nix.tmpl", "home.nix", data, force)
+}
+
+// writeShared writes the files generated from the
+// configuration that every system uses.
+func (f *Flake) writeShared(data Data, force bool) error {
+	err := f.writeFile("templates/flake.nix.tmpl", "flake.nix", data, force)
 	if err != nil {
 		return err
 	}
-	err = f.writeFile("templates/aliases.nix.tmpl", "aliases.nix", data, force)
+	err = f.writeFile("templates/README.md.tmpl", "README.md", data, force)
 	if err != nil {
 		return err
 	}
-	err = f.writeFile("templates/path.nix.tmpl", "path.nix", data, force)
+	err = f.writeGitignore(data)
 	if err != nil {
 		return err
 	}
-	err = f.writeFile("templates/programs.nix.tmpl", "programs.nix", data, force)
+	for _, name := range []string{"home.nix", "aliases.nix", "path.nix", "programs.nix", "shell.nix"} {
+		err = f.writeFile("templates/"+name+".tmpl", name, data, force)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RenderTo writes the complete generated flake to dir
+// instead of the flake directory, including user.nix and
+// the host files for every system that has a user. Nothing
+// is committed and the configuration isn't modified.
+func (f *Flake) RenderTo(dir string) error {
+	bling, err := f.Config.CurrentBling()
 	if err != nil {
 		return err
 	}
-	err = f.writeFile("templates/shell.nix.tmpl", "shell.nix", data, force)
+	data := Data{
+		Config: f.Config,
+		Bling:  bling,
+	}
+	f.dir = dir
+	defer func() { f.dir = "" }()
+	err = f.writeShared(data, true)
 	if err != nil {
 		return err
 	}
-	sys, err := f.Config.CurrentSystem()
+	err = f.writeFile("templates/user.nix.tmpl", "user.nix", data, true)
 	if err != nil {
 		return err
 	}
-	if writeHost {
-
-		err = f.writeSystem(sys, "templates/host.nix.tmpl", force)
+	for _, sys := range f.Config.Systems {
+		if sys.User == nil {
+			continue
+		}
+		err = f.writeSystem(sys, "templates/host.nix.tmpl", true)
 		if err != nil {
 			return err
 		}
-	}
-	if writeUser {
-
-		//user := f.Config.UserForSystem(sys.Hostname)
-		user := sys.User
-		err = f.writeUser(*sys, *user, "templates/user.nix.tmpl", true)
+		err = f.writeUser(*sys, *sys.User, "templates/user.nix.tmpl", true)
 		if err != nil {
 			return err
 		}
 	}
-
-	spinner.Success()
-	err = f.mayCommit(message)
-
-	if err != nil {
-		return err
-	}
 	return nil
+}
 
+// outputDir is the directory generated files are
+// written to, the flake directory unless rendering
+// somewhere else with RenderTo.
+func (f *Flake) outputDir() string {
+	if f.dir != "" {
+		return f.dir
+	}
+	return f.Config.UserFlakeDir()
 }
 
 func (f *Flake) ensureFlakeDir() error {
@@ -430,7 +467,7 @@ func (f *Flake) ReadConfig(loc string) error {
 	return nil
 }
 func (f *Flake) writeFile(template string, path string, d Data, force bool) error {
-	fpath := filepath.Join(f.Config.UserFlakeDir(), path)
+	fpath := filepath.Join(f.outputDir(), path)
 	err := os.MkdirAll(filepath.Dir(fpath), 0755)
 	if err != nil {
 		fin.Logger.Debug("mkdir", fin.Logger.Args("error", err))
@@ -462,10 +499,20 @@ func (f *Flake) writeFile(template string, path string, d Data, force bool) erro
 	return nil
 }
 
+// writeGitignore writes the default .gitignore to the
+// flake directory unless the user already has one.
+func (f *Flake) writeGitignore(d Data) error {
+	if fleek.Exists(filepath.Join(f.outputDir(), ".gitignore")) {
+		return nil
+	}
+	return f.writeFile("templates/.gitignore.tmpl", ".gitignore", d, false)
+}
+
 func (f *Flake) writeSystem(sys *fleek.System, template string, force bool) error {
-	var user *fleek.User
-	var err error
-	user = f.Config.UserForSystem(sys.Hostname)
+	user, err := f.Config.UserForSystem(sys.Hostname)
+	if err != nil {
+		return err
+	}
 	if user == nil {
 		user, err = fleek.NewUser()
 		if err != nil {
@@ -486,7 +533,7 @@ func (f *Flake) writeSystem(sys *fleek.System, template string, force bool) erro
 		sysData.BYOGit = true
 	}
 
-	hostPath := filepath.Join(f.Config.UserFlakeDir(), sys.Hostname)
+	hostPath := filepath.Join(f.outputDir(), sys.Hostname)
 	err = os.MkdirAll(hostPath, 0755)
 	if err != nil {
 		return err
@@ -513,7 +560,7 @@ func (f *Flake) writeSystem(sys *fleek.System, template string, force bool) erro
 }
 func (f *Flake) writeUser(sys fleek.System, user fleek.User, template string, force bool) error {
 
-	hostPath := filepath.Join(f.Config.UserFlakeDir(), sys.Hostname)
+	hostPath := filepath.Join(f.outputDir(), sys.Hostname)
 	err := os.MkdirAll(hostPath, 0755)
 	if err != nil {
 		return err
@@ -542,7 +589,7 @@ func (f *Flake) writeUser(sys fleek.System, user fleek.User, template string, fo
 func (f *Flake) WriteTemplates() error {
 
 	writeCmdLine := []string{"run", ".#fleek", "--", "write"}
-	err := f.runNix(nixbin, writeCmdLine)
+	err := f.runNix(fleek.NixBinary(), writeCmdLine)
 	if err != nil {
 		return err
 	}
@@ -554,6 +601,19 @@ func (f *Flake) WriteTemplates() error {
 	return nil
 }
 func (f *Flake) Apply() error {
+	return f.ApplyContext(context.Background())
+}
+
+// ApplyContext is like Apply but the nix command
+// is cancelled when ctx is done.
+func (f *Flake) ApplyContext(ctx context.Context) error {
+	return f.applyContext(ctx, nil)
+}
+
+// applyContext runs the home-manager switch. When log isn't
+// nil each command line and all of its output are also
+// written to log.
+func (f *Flake) applyContext(ctx context.Context, log io.Writer) error {
 	fin.Logger.Info(f.app.Trans("flake.apply"))
 
 	user, err := fleek.Username()
@@ -565,19 +625,72 @@ func (f *Flake) Apply() error {
 	if err != nil {
 		return err
 	}
+	// the flake output uses the hostname as it's stored,
+	// which may be the short or fully qualified form
+	if sys, err := f.Config.CurrentSystem(); err == nil {
+		host = sys.Hostname
+	}
 	applyCmdLine := []string{"run", "--no-write-lock-file", "--impure", "home-manager/master", "--", "-b", "bak", "switch", "--flake", ".#" + user + "@" + host}
 	if debug.IsEnabled() {
 		applyCmdLine = append(applyCmdLine, "--show-trace")
 	}
-	err = f.runNix(nixbin, applyCmdLine)
-	if err != nil {
+	run := func(cmdLine []string, stderr io.Writer) error {
+		if log == nil {
+			return f.runNixContextStderr(ctx, fleek.NixBinary(), cmdLine, stderr)
+		}
+		fmt.Fprintf(log, "$ %s %s\n", fleek.NixBinary(), strings.Join(cmdLine, " "))
+		if stderr != nil {
+			stderr = io.MultiWriter(stderr, log)
+		} else {
+			stderr = log
+		}
+		return f.runNixContextOutput(ctx, fleek.NixBinary(), cmdLine, log, stderr)
+	}
+	var stderr bytes.Buffer
+	err = run(applyCmdLine, &stderr)
+	if err == nil {
+		return nil
+	}
+	if !strings.Contains(stderr.String(), pureEvalError) {
 		return err
 	}
-	return nil
+	if !f.Config.AllowImpure {
+		return fmt.Errorf("%w: %v", ErrImpureRequired, err)
+	}
+	fin.Logger.Info(f.app.Trans("flake.impureRetry"))
+	return run(append(applyCmdLine, "--impure"), nil)
 }
 func (f *Flake) runNix(cmd string, cmdLine []string) error {
+	return f.runNixContext(context.Background(), cmd, cmdLine)
+}
 
-	command := cmdutil.CommandTTY(cmd, cmdLine...)
+func (f *Flake) runNixContext(ctx context.Context, cmd string, cmdLine []string) error {
+	return f.runNixContextStderr(ctx, cmd, cmdLine, nil)
+}
+
+// runNixContextStderr is like runNixContext but also
+// copies the command's stderr to stderr when it isn't nil.
+func (f *Flake) runNixContextStderr(ctx context.Context, cmd string, cmdLine []string, stderr io.Writer) error {
+	return f.runNixContextOutput(ctx, cmd, cmdLine, nil, stderr)
+}
+
+// runNixContextOutput is like runNixContextStderr but
+// also copies the command's stdout to stdout. Output goes
+// to the event stream instead of the terminal during an
+// ...Events call.
+func (f *Flake) runNixContextOutput(ctx context.Context, cmd string, cmdLine []string, stdout, stderr io.Writer) error {
+	if fleek.OfflineMode {
+		return fleek.ErrOfflineMode
+	}
+
+	command := cmdutil.CommandTTYContext(ctx, cmd, cmdLine...)
+	defer f.redirect(command)()
+	if stdout != nil {
+		command.Stdout = io.MultiWriter(command.Stdout, stdout)
+	}
+	if stderr != nil {
+		command.Stderr = io.MultiWriter(command.Stderr, stderr)
+	}
 
 	command.Dir = f.Config.UserFlakeDir()
 	fin.Logger.Debug("running nix command", fin.Logger.Args("directory", command.Dir))
@@ -590,7 +703,7 @@ func (f *Flake) runNix(cmd string, cmdLine []string) error {
 
 }
 func ForceProfile() error {
-	cmd := cmdutil.CommandTTY("nix", "profile", "list")
+	cmd := cmdutil.CommandTTY(fleek.NixBinary(), "profile", "list")
 	cmd.Stdin = os.Stdin
 	cmd.Stderr = io.Discard
 	cmd.Stdout = io.Discard
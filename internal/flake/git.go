@@ -1,15 +1,23 @@
 package flake
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/ublue-os/fleek/fin"
 	"github.com/ublue-os/fleek/internal/cmdutil"
+	"github.com/ublue-os/fleek/internal/fleek"
 	fgit "github.com/ublue-os/fleek/internal/git"
+	"golang.org/x/term"
 )
 
 const gitbin = "git"
@@ -21,27 +29,177 @@ func (f *Flake) gitOpen() (*git.Repository, error) {
 }
 
 func (f *Flake) Clone(repo string) error {
+	return f.CloneContext(context.Background(), repo)
+}
+
+// CloneContext is like Clone but the git command
+// is cancelled when ctx is done.
+func (f *Flake) CloneContext(ctx context.Context, repo string) error {
+	return f.cloneBranchContext(ctx, repo, "")
+}
+
+// ErrInvalidBranch is returned by CloneBranch for an
+// empty branch name or one that looks like a flag.
+var ErrInvalidBranch = errors.New("invalid git branch name")
+
+// CloneBranch is like Clone but checks out branch
+// instead of the repository's default branch.
+func (f *Flake) CloneBranch(repo, branch string) error {
+	branch = strings.TrimSpace(branch)
+	if branch == "" || strings.HasPrefix(branch, "-") {
+		return fmt.Errorf("%w: %q", ErrInvalidBranch, branch)
+	}
+	return f.cloneBranchContext(context.Background(), repo, branch)
+}
+
+// cloneBranchContext clones repo into the flake directory,
+// checking out branch unless it's empty.
+func (f *Flake) cloneBranchContext(ctx context.Context, repo, branch string) error {
 	if f.Config.Verbose {
 		fin.Verbose.Printfln("Cloning %s to %s", repo, f.Config.UserFlakeDir())
 	}
-	cloneCmdline := []string{"clone", repo, f.Config.UserFlakeDir()}
-
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return err
 	}
-	cmd := cmdutil.CommandTTY(gitbin, cloneCmdline...)
-	cmd.Dir = home
-	cmd.Env = os.Environ()
-	err = cmd.Run()
+	if fleek.InsideGitRepo(filepath.Dir(f.Config.UserFlakeDir())) {
+		fin.Logger.Warn(f.app.Trans("git.nestedClone"), fin.Logger.Args("dir", f.Config.UserFlakeDir()))
+	}
+	out, flush := f.eventOutput()
+	defer flush()
+	return cloneWithRetry(ctx, repo, branch, f.Config.UserFlakeDir(), home, out)
+}
+
+// CloneAttempts is the number of times a git clone is
+// tried before giving up.
+var CloneAttempts = 3
+
+// CloneBackoff is the delay before the second clone
+// attempt. It doubles after each failure.
+var CloneBackoff = 2 * time.Second
+
+// transientCloneErrors are the git and curl messages for
+// network failures that may succeed when retried. Anything
+// else, like failed authentication, a missing repository
+// or a bad URL, fails the clone at once.
+var transientCloneErrors = []string{
+	"Connection timed out",
+	"Operation timed out",
+	"Connection reset",
+	"Failed to connect",
+	"Temporary failure in name resolution",
+	"early EOF",
+	"the remote end hung up unexpectedly",
+	"RPC failed",
+	"gnutls_handshake() failed",
+	"SSL_ERROR_SYSCALL",
+}
+
+// cloneWithRetry runs `git clone repo dest` from workDir,
+// with `--branch branch` unless branch is empty, retrying
+// transient network failures, see transientCloneErrors.
+// A partial clone is removed between
+// attempts, leaving dest as it was found. Output goes to
+// out, or the terminal if out is nil. When git writes
+// straight to a terminal every failure is retried.
+func cloneWithRetry(ctx context.Context, repo, branch, dest, workDir string, out io.Writer) error {
+	if fleek.OfflineMode {
+		return fleek.ErrOfflineMode
+	}
+	existed, empty := dirState(dest)
+	backoff := CloneBackoff
+	args := []string{"clone", repo, dest}
+	if branch != "" {
+		args = []string{"clone", "--branch", branch, repo, dest}
+	}
+	var err error
+	for attempt := 1; attempt <= CloneAttempts; attempt++ {
+		command := cmdutil.CommandTTYContext(ctx, gitbin, args...)
+		if out != nil {
+			command.Stdout = out
+			command.Stderr = out
+		}
+		// keep git's progress on a terminal, we can't tell
+		// a transient failure from its output then
+		var stderr *bytes.Buffer
+		if !isTerminal(command.Stderr) {
+			stderr = &bytes.Buffer{}
+			command.Stderr = io.MultiWriter(command.Stderr, stderr)
+		}
+		command.Dir = workDir
+		// transientCloneErrors are the untranslated messages
+		command.Env = append(os.Environ(), "LC_ALL=C")
+		err = command.Run()
+		if err == nil {
+			return nil
+		}
+		if empty {
+			cleanPartialClone(dest, existed)
+		}
+		if attempt == CloneAttempts || (stderr != nil && !isTransient(stderr.String())) {
+			break
+		}
+		fin.Logger.Debug("git clone failed, retrying", fin.Logger.Args("attempt", attempt, "error", err))
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("git clone: %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return fmt.Errorf("git clone: %w", err)
+}
+
+// isTerminal reports whether w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// isTransient reports whether the clone output
+// matches one of transientCloneErrors.
+func isTransient(output string) bool {
+	for _, msg := range transientCloneErrors {
+		if strings.Contains(output, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// dirState reports whether dir exists and whether it
+// is missing or empty, so it's safe to clean up.
+func dirState(dir string) (existed bool, empty bool) {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		return fmt.Errorf("git clone: %w", err)
+		return false, errors.Is(err, fs.ErrNotExist)
+	}
+	return true, len(entries) == 0
+}
+
+// cleanPartialClone removes anything a failed clone left
+// in dir, removing dir itself if it didn't exist before.
+func cleanPartialClone(dir string, existed bool) {
+	if !existed {
+		_ = os.RemoveAll(dir)
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		_ = os.RemoveAll(filepath.Join(dir, e.Name()))
 	}
-	return nil
 }
 
 func (f *Flake) runGit(cmd string, cmdLine []string) error {
-	command := cmdutil.CommandTTY(cmd, cmdLine...)
+	return f.runGitContext(context.Background(), cmd, cmdLine)
+}
+
+func (f *Flake) runGitContext(ctx context.Context, cmd string, cmdLine []string) error {
+	command := cmdutil.CommandTTYContext(ctx, cmd, cmdLine...)
+	defer f.redirect(command)()
 	command.Dir = f.Config.UserFlakeDir()
 	command.Env = os.Environ()
 	return command.Run()
@@ -88,6 +246,9 @@ func (f *Flake) mayCommit(message string) error {
 				fin.Logger.Error("git commit", fin.Logger.Args("error", err))
 				return err
 			}
+			if fleek.IsSubmodule(f.Config.UserFlakeDir()) {
+				fin.Logger.Warn(f.app.Trans("git.submodule"))
+			}
 
 		}
 
@@ -167,6 +328,9 @@ func (f *Flake) commit(message string) error {
 }
 
 func (f *Flake) pull() error {
+	if fleek.OfflineMode {
+		return fleek.ErrOfflineMode
+	}
 	remote, err := f.remote()
 	if err != nil {
 		return err
@@ -194,6 +358,9 @@ func (f *Flake) setRebase() error {
 	return err
 }
 func (f *Flake) push() error {
+	if fleek.OfflineMode {
+		return fleek.ErrOfflineMode
+	}
 	remote, err := f.remote()
 	if err != nil {
 		return err
@@ -248,18 +415,20 @@ func (f *Flake) remote() (string, error) {
 	return urls, nil
 }
 func CloneRepository(repo string) (string, error) {
+	return CloneRepositoryContext(context.Background(), repo)
+}
+
+// CloneRepositoryContext is like CloneRepository but the
+// git command is cancelled when ctx is done.
+func CloneRepositoryContext(ctx context.Context, repo string) (string, error) {
 
 	dirname, err := os.MkdirTemp("", "fleek*")
 	if err != nil {
 		return "", err
 	}
-	cloneCmdline := []string{"clone", repo, dirname}
-	command := cmdutil.CommandTTY(gitbin, cloneCmdline...)
-
-	command.Env = os.Environ()
-	err = command.Run()
+	err = cloneWithRetry(ctx, repo, "", dirname, "", nil)
 	if err != nil {
-		return "", fmt.Errorf("git clone: %w", err)
+		return "", err
 	}
 	return dirname, nil
 }
@@ -0,0 +1,100 @@
+package flake
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ublue-os/fleek/fin"
+	"github.com/ublue-os/fleek/internal/fleek"
+)
+
+var ErrNoConfigOrRepo = errors.New("no configuration found and no repository to clone")
+
+// InstallError reports the stage of InstallProfile
+// that failed.
+type InstallError struct {
+	Stage string
+	Err   error
+}
+
+func (e *InstallError) Error() string {
+	return fmt.Sprintf("install profile: %s: %v", e.Stage, e.Err)
+}
+
+func (e *InstallError) Unwrap() error {
+	return e.Err
+}
+
+// InstallProfile sets fleek up without prompting, for
+// provisioning scripts. configPath is the directory holding
+// the configuration file, absolute or relative to $HOME. If
+// there is no configuration there, repo is cloned into it.
+// The configuration is then validated, the local system is
+// registered if it's missing, using DetectUser for the git
+// user, and the flake is written and applied. Running it
+// again on a machine that is already set up only applies.
+// Errors are an *InstallError naming the failed stage.
+func (f *Flake) InstallProfile(configPath, repo string) error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return &InstallError{"home directory", err}
+	}
+	dir := configPath
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(home, dir)
+	}
+	if !fleek.Exists(filepath.Join(dir, ".fleek.yml")) {
+		if repo == "" {
+			return &InstallError{"read config", fmt.Errorf("%w: %s", ErrNoConfigOrRepo, dir)}
+		}
+		rel, err := filepath.Rel(home, dir)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return &InstallError{"clone", fmt.Errorf("flake directory must be inside %s: %s", home, dir)}
+		}
+		f.Config.FlakeDir = rel
+		fin.Logger.Debug("install profile: cloning", fin.Logger.Args("repo", repo, "dir", dir))
+		err = f.Clone(repo)
+		if err != nil {
+			return &InstallError{"clone", err}
+		}
+	}
+	config, err := fleek.ReadConfig(dir)
+	if err != nil {
+		return &InstallError{"read config", err}
+	}
+	err = config.Validate()
+	if err != nil {
+		return &InstallError{"validate", err}
+	}
+	user, err := fleek.DetectUser()
+	if err != nil {
+		return &InstallError{"register system", err}
+	}
+	err = registerSystem(config, user)
+	if err != nil {
+		return &InstallError{"register system", err}
+	}
+	if _, override := fleek.ConfigOverride(); !override {
+		loc, err := config.Location()
+		if err != nil {
+			return &InstallError{"symlink", err}
+		}
+		err = fleek.ForceSymlink(loc, filepath.Join(home, ".fleek.yml"))
+		if err != nil {
+			return &InstallError{"symlink", err}
+		}
+	}
+	f.Config = config
+	err = f.Write("fleek: install profile", true, true)
+	if err != nil {
+		return &InstallError{"write flake", err}
+	}
+	err = f.Apply()
+	if err != nil {
+		return &InstallError{"apply", err}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package flake
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/ublue-os/fleek/fin"
+	"github.com/ublue-os/fleek/internal/fleek"
+)
+
+var ErrNoLockFile = errors.New("flake.lock not found, run `fleek apply` to create it")
+
+// lockFile is the subset of flake.lock that fleek reads.
+type lockFile struct {
+	Nodes   map[string]lockNode `json:"nodes"`
+	Root    string              `json:"root"`
+	Version int                 `json:"version"`
+}
+
+type lockNode struct {
+	Inputs map[string]json.RawMessage `json:"inputs"`
+	Locked map[string]interface{}     `json:"locked"`
+}
+
+// rootInputs returns the locked attributes of each direct
+// input of the flake, keyed by input name.
+func (l *lockFile) rootInputs() map[string]map[string]interface{} {
+	inputs := make(map[string]map[string]interface{})
+	root, ok := l.Nodes[l.Root]
+	if !ok {
+		return inputs
+	}
+	for name, ref := range root.Inputs {
+		var node string
+		// follows are lists of input names, skip them
+		if err := json.Unmarshal(ref, &node); err != nil {
+			continue
+		}
+		inputs[name] = l.Nodes[node].Locked
+	}
+	return inputs
+}
+
+func (f *Flake) readLockFile() (*lockFile, error) {
+	bb, err := os.ReadFile(filepath.Join(f.Config.UserFlakeDir(), "flake.lock"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNoLockFile
+		}
+		return nil, err
+	}
+	var l lockFile
+	err = json.Unmarshal(bb, &l)
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// InputsChanged reports whether any flake input has a newer
+// revision than the one pinned in flake.lock. Nothing is written
+// to disk. If there is no flake.lock yet, every input is
+// unpinned and InputsChanged returns true.
+func (f *Flake) InputsChanged() (bool, error) {
+	if fleek.OfflineMode {
+		return false, fleek.ErrOfflineMode
+	}
+	current, err := f.readLockFile()
+	if err != nil {
+		if errors.Is(err, ErrNoLockFile) {
+			return true, nil
+		}
+		return false, err
+	}
+	command := exec.Command(fleek.NixBinary(), "flake", "metadata", "--json", "--refresh", "--recreate-lock-file", "--no-write-lock-file")
+	command.Dir = f.Config.UserFlakeDir()
+	command.Env = os.Environ()
+	bb, err := command.Output()
+	if err != nil {
+		return false, err
+	}
+	var metadata struct {
+		Locks lockFile `json:"locks"`
+	}
+	err = json.Unmarshal(bb, &metadata)
+	if err != nil {
+		return false, err
+	}
+	pinned := current.rootInputs()
+	for name, latest := range metadata.Locks.rootInputs() {
+		locked, ok := pinned[name]
+		if !ok || locked["narHash"] != latest["narHash"] {
+			fin.Logger.Debug("input changed", fin.Logger.Args("input", name))
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// LockedInput is the pinned version of a flake input.
+type LockedInput struct {
+	Rev          string
+	LastModified time.Time
+	NarHash      string
+}
+
+// FlakeLockInfo returns the pinned version of each direct
+// input in flake.lock, keyed by input name. It returns
+// ErrNoLockFile if the flake hasn't been locked yet.
+func (f *Flake) FlakeLockInfo() (map[string]LockedInput, error) {
+	l, err := f.readLockFile()
+	if err != nil {
+		return nil, err
+	}
+	info := make(map[string]LockedInput)
+	for name, locked := range l.rootInputs() {
+		var in LockedInput
+		in.Rev, _ = locked["rev"].(string)
+		in.NarHash, _ = locked["narHash"].(string)
+		if modified, ok := locked["lastModified"].(float64); ok {
+			in.LastModified = time.Unix(int64(modified), 0)
+		}
+		info[name] = in
+	}
+	return info, nil
+}
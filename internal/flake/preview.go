@@ -0,0 +1,104 @@
+package flake
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/ublue-os/fleek/fin"
+	"github.com/ublue-os/fleek/internal/cmdutil"
+	"github.com/ublue-os/fleek/internal/fleek"
+)
+
+// ApplyPreview builds the home-manager configuration for
+// the named host without switching to it, and returns a
+// diff against the current generation. nvd is used when it
+// is installed, then `nix store diff-closures`. If neither
+// works, or there is no current generation, the store path
+// of the build is returned instead.
+func (f *Flake) ApplyPreview(system string) (string, error) {
+	if fleek.OfflineMode {
+		return "", fleek.ErrOfflineMode
+	}
+	sys, err := f.Config.System(system)
+	if err != nil {
+		return "", err
+	}
+	built, err := f.buildActivation(sys.Username, sys.Hostname)
+	if err != nil {
+		return "", err
+	}
+
+	current, err := currentGeneration()
+	if err != nil {
+		return built, nil
+	}
+	if cmdutil.Exists("nvd") {
+		if diff, err := exec.Command("nvd", "diff", current, built).Output(); err == nil {
+			return string(diff), nil
+		}
+	}
+	if diff, err := exec.Command(fleek.NixBinary(), "store", "diff-closures", current, built).Output(); err == nil {
+		return string(diff), nil
+	}
+	return built, nil
+}
+
+// buildActivation builds the home-manager activation
+// package for user on the named host and returns its
+// store path. Like Apply, the build is only retried with
+// --impure when pure evaluation fails and AllowImpure is set.
+func (f *Flake) buildActivation(user, system string) (string, error) {
+	target := fmt.Sprintf(".#homeConfigurations.\"%s@%s\".activationPackage", user, system)
+	build := func(impure bool) (string, string, error) {
+		args := []string{"build", "--no-link", "--print-out-paths", target}
+		if impure {
+			args = append(args, "--impure")
+		}
+		command := exec.Command(fleek.NixBinary(), args...)
+		command.Dir = f.Config.UserFlakeDir()
+		command.Env = os.Environ()
+		var stderr bytes.Buffer
+		command.Stderr = io.MultiWriter(os.Stderr, &stderr)
+		if f.Config.Unfree {
+			command.Env = append(command.Env, "NIXPKGS_ALLOW_UNFREE=1")
+		}
+		bb, err := command.Output()
+		return strings.TrimSpace(string(bb)), stderr.String(), err
+	}
+	built, stderr, err := build(false)
+	if err != nil && strings.Contains(stderr, pureEvalError) {
+		if !f.Config.AllowImpure {
+			return "", fmt.Errorf("%w: %v", ErrImpureRequired, err)
+		}
+		fin.Logger.Info(f.app.Trans("flake.impureRetry"))
+		built, _, err = build(true)
+	}
+	if err != nil {
+		return "", fmt.Errorf("home-manager build: %w", err)
+	}
+	return built, nil
+}
+
+// currentGeneration resolves the active home-manager
+// generation to its store path.
+func currentGeneration() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	profiles := []string{
+		filepath.Join(home, ".local", "state", "nix", "profiles", "home-manager"),
+		filepath.Join("/nix", "var", "nix", "profiles", "per-user", os.Getenv("USER"), "home-manager"),
+	}
+	for _, p := range profiles {
+		if resolved, err := filepath.EvalSymlinks(p); err == nil {
+			return resolved, nil
+		}
+	}
+	return "", os.ErrNotExist
+}
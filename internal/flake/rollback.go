@@ -0,0 +1,56 @@
+package flake
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/ublue-os/fleek/fin"
+	"github.com/ublue-os/fleek/internal/cmdutil"
+	"github.com/ublue-os/fleek/internal/fleek"
+)
+
+var (
+	ErrNoPreviousGeneration = errors.New("no previous home-manager generation to roll back to")
+	ErrRemoteRollback       = errors.New("only the local system can be rolled back")
+)
+
+// generationLine matches a line of `home-manager generations`
+// output, capturing the generation id and store path.
+var generationLine = regexp.MustCompile(`id (\d+) -> (\S+)`)
+
+// Rollback activates the home-manager generation before
+// the current one. Generations only exist on the machine
+// they were built on, so system must be empty or the
+// local hostname.
+func (f *Flake) Rollback(system string) error {
+	if fleek.OfflineMode {
+		return fleek.ErrOfflineMode
+	}
+	host, err := fleek.Hostname()
+	if err != nil {
+		return err
+	}
+	if system != "" && !fleek.SameHost(system, host) {
+		return fmt.Errorf("%w: %s", ErrRemoteRollback, system)
+	}
+	cmd, buf := cmdutil.CommandTTYWithBuffer(fleek.NixBinary(), "run", "home-manager/master", "--", "generations")
+	cmd.Env = os.Environ()
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("home-manager generations: %w", err)
+	}
+	// generations are listed newest first
+	matches := generationLine.FindAllSubmatch(buf.Bytes(), 2)
+	if len(matches) < 2 {
+		return ErrNoPreviousGeneration
+	}
+	id, path := string(matches[1][1]), string(matches[1][2])
+	fin.Logger.Info("activating generation", fin.Logger.Args("id", id, "path", path))
+	err = activate(path)
+	if err != nil {
+		return fmt.Errorf("activating generation %s: %w", id, err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package flake
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ublue-os/fleek/fin"
+	"github.com/ublue-os/fleek/internal/cmdutil"
+	"github.com/ublue-os/fleek/internal/fleek"
+)
+
+// SafeApply builds the home-manager configuration for the
+// local system and activates it only if the build succeeds.
+// If activation fails the generation that was active before
+// is activated again and the activation error is returned,
+// joined with the rollback error if that fails too. Like
+// Rollback, system must be empty or the local hostname.
+func (f *Flake) SafeApply(system string) error {
+	if fleek.OfflineMode {
+		return fleek.ErrOfflineMode
+	}
+	host, err := fleek.Hostname()
+	if err != nil {
+		return err
+	}
+	if system != "" && !fleek.SameHost(system, host) {
+		return fmt.Errorf("%w: %s", ErrRemoteApply, system)
+	}
+	user, err := fleek.Username()
+	if err != nil {
+		return err
+	}
+	if sys, err := f.Config.CurrentSystem(); err == nil {
+		host = sys.Hostname
+	}
+	fin.Logger.Info(f.app.Trans("flake.apply"))
+	built, err := f.buildActivation(user, host)
+	if err != nil {
+		return err
+	}
+	// no previous generation on a first apply
+	previous, _ := currentGeneration()
+	err = activate(built)
+	if err == nil {
+		return nil
+	}
+	err = fmt.Errorf("activating %s: %w", built, err)
+	if previous == "" {
+		fin.Logger.Error("activation failed, no previous generation to roll back to", fin.Logger.Args("error", err))
+		return err
+	}
+	fin.Logger.Warn("activation failed, rolling back", fin.Logger.Args("generation", previous, "error", err))
+	rollbackErr := activate(previous)
+	if rollbackErr != nil {
+		fin.Logger.Error("rollback failed", fin.Logger.Args("generation", previous, "error", rollbackErr))
+		return errors.Join(err, fmt.Errorf("rolling back to %s: %w", previous, rollbackErr))
+	}
+	fin.Logger.Info("rolled back", fin.Logger.Args("generation", previous))
+	return err
+}
+
+// activate runs the activation script of the home-manager
+// generation at path, streaming its output. Existing files
+// in the way are backed up with a .bak extension, like the
+// `-b bak` Apply passes to home-manager switch.
+func activate(path string) error {
+	cmd := cmdutil.CommandTTY(filepath.Join(path, "activate"))
+	cmd.Env = append(os.Environ(), "HOME_MANAGER_BACKUP_EXT=bak")
+	return cmd.Run()
+}
@@ -0,0 +1,57 @@
+package flake
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/ublue-os/fleek/fin"
+	"github.com/ublue-os/fleek/internal/fleek"
+)
+
+var ErrSpecialisationNotFound = errors.New("specialisation not found for the system")
+
+// ApplySystem applies the flake for system and, if
+// specialisation isn't empty, activates that specialisation
+// of it instead of the base configuration. Like SafeApply,
+// system must be empty or the local hostname, and the
+// system is the one registered for the current user.
+// Running Apply again switches back to the base
+// configuration.
+func (f *Flake) ApplySystem(system, specialisation string) error {
+	host, err := fleek.Hostname()
+	if err != nil {
+		return err
+	}
+	if system != "" && !fleek.SameHost(system, host) {
+		return fmt.Errorf("%w: %s", ErrRemoteApply, system)
+	}
+	if specialisation == "" {
+		return f.Apply()
+	}
+	if fleek.OfflineMode {
+		return fleek.ErrOfflineMode
+	}
+	sys, err := f.Config.CurrentSystem()
+	if err != nil {
+		return err
+	}
+	if _, ok := sys.Specialisations[specialisation]; !ok {
+		return fmt.Errorf("%w: %s", ErrSpecialisationNotFound, specialisation)
+	}
+	fin.Logger.Info(f.app.Trans("flake.apply"))
+	built, err := f.buildActivation(sys.Username, sys.Hostname)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(built, "specialisation", specialisation)
+	if !fleek.IsDir(path) {
+		return fmt.Errorf("%w: %s is missing from %s", ErrSpecialisationNotFound, specialisation, built)
+	}
+	fin.Logger.Info("activating specialisation", fin.Logger.Args("name", specialisation))
+	err = activate(path)
+	if err != nil {
+		return fmt.Errorf("activating specialisation %s: %w", specialisation, err)
+	}
+	return nil
+}
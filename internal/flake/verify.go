@@ -0,0 +1,94 @@
+package flake
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ublue-os/fleek/fin"
+	"github.com/ublue-os/fleek/internal/cmdutil"
+	"github.com/ublue-os/fleek/internal/fleek"
+)
+
+// VerifyTimeout is the maximum time `nix flake check`
+// is allowed to run before it is cancelled.
+var VerifyTimeout = 10 * time.Minute
+
+var ErrVerifyTimeout = errors.New("nix flake check timed out")
+
+// CheckError summarizes the failures reported
+// by `nix flake check`.
+type CheckError struct {
+	Failures []string
+	Err      error
+}
+
+func (e *CheckError) Error() string {
+	if len(e.Failures) == 0 {
+		return fmt.Sprintf("nix flake check: %v", e.Err)
+	}
+	return fmt.Sprintf("nix flake check: %d failure(s):\n%s", len(e.Failures), strings.Join(e.Failures, "\n"))
+}
+
+func (e *CheckError) Unwrap() error {
+	return e.Err
+}
+
+// VerifyFlake runs `nix flake check` in the flake directory,
+// streaming its output to the terminal. The nix binary can be
+// overridden with the FLEEK_NIX_BIN environment variable.
+func (f *Flake) VerifyFlake() error {
+	return f.VerifyFlakeContext(context.Background())
+}
+
+// VerifyFlakeContext is like VerifyFlake but the check
+// is also cancelled when ctx is done.
+func (f *Flake) VerifyFlakeContext(ctx context.Context) error {
+	if fleek.OfflineMode {
+		return fleek.ErrOfflineMode
+	}
+	ctx, cancel := context.WithTimeout(ctx, VerifyTimeout)
+	defer cancel()
+
+	command := cmdutil.CommandTTYContext(ctx, fleek.NixBinary(), "flake", "check")
+	var errBuf bytes.Buffer
+	command.Stderr = io.MultiWriter(os.Stderr, &errBuf)
+	command.Dir = f.Config.UserFlakeDir()
+	command.Env = os.Environ()
+	if f.Config.Unfree {
+		command.Env = append(command.Env, "NIXPKGS_ALLOW_UNFREE=1")
+	}
+	fin.Logger.Debug("running nix flake check", fin.Logger.Args("directory", command.Dir))
+
+	err := command.Run()
+	if err == nil {
+		return nil
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = ErrVerifyTimeout
+	}
+	return &CheckError{
+		Failures: checkFailures(errBuf.Bytes()),
+		Err:      err,
+	}
+}
+
+// checkFailures returns the `error:` lines
+// from nix command output.
+func checkFailures(output []byte) []string {
+	var failures []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "error:") {
+			failures = append(failures, line)
+		}
+	}
+	return failures
+}
@@ -0,0 +1,386 @@
+package fleek
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrCircularBase = errors.New("fleek.yml: circular `base` reference")
+	ErrSetByBase    = errors.New("fleek.yml: set by the base configuration, remove it there")
+)
+
+// ResolveConfig returns a copy of the configuration with
+// its Base configuration, and any bases of that configuration,
+// layered underneath it. Scalar values set in the local
+// configuration file win, even when they are false, zero or
+// empty, lists are unioned and map keys from the local
+// configuration replace those from the base.
+func (c *Config) ResolveConfig() (*Config, error) {
+	return c.resolve(map[string]bool{})
+}
+
+// Flatten returns the effective configuration as a single
+// self-contained copy: the Base chain is resolved and
+// inlined and Base is cleared, so marshaling the copy shows
+// every value in force. The configuration and its file are
+// unchanged. The copy has no location, don't Save it over
+// the original.
+func (c *Config) Flatten() (*Config, error) {
+	resolved := c
+	if c.Base != "" && c.base == nil {
+		var err error
+		resolved, err = c.ResolveConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+	flat, err := resolved.clone()
+	if err != nil {
+		return nil, err
+	}
+	flat.Base = ""
+	return flat, nil
+}
+
+func (c *Config) resolve(seen map[string]bool) (*Config, error) {
+	merged, err := c.clone()
+	if err != nil {
+		return nil, err
+	}
+	c.copyState(merged)
+	if c.Base == "" {
+		return merged, nil
+	}
+	if c.location != "" {
+		seen[canonicalPath(c.location)] = true
+	}
+	loc, err := c.baseLocation()
+	if err != nil {
+		return nil, err
+	}
+	if seen[canonicalPath(loc)] {
+		return nil, fmt.Errorf("%w: %s", ErrCircularBase, c.Base)
+	}
+	seen[canonicalPath(loc)] = true
+	base, err := readConfigFile(loc, false)
+	if err != nil {
+		return nil, fmt.Errorf("reading base %s: %w", c.Base, err)
+	}
+	base, err = base.resolve(seen)
+	if err != nil {
+		return nil, err
+	}
+	overlay(reflect.ValueOf(merged).Elem(), reflect.ValueOf(base).Elem(), c.keys)
+	merged.base = base
+	merged.file = c
+	return merged, nil
+}
+
+// baseLocation returns the path of the base configuration
+// file. Flake references are fetched into the nix store,
+// relative paths are resolved against the directory of the
+// configuration that references them.
+func (c *Config) baseLocation() (string, error) {
+	dir := c.Base
+	if isFlakeRef(c.Base) {
+		storePath, err := prefetchFlake(c.Base)
+		if err != nil {
+			return "", err
+		}
+		dir = storePath
+	} else {
+		if strings.HasPrefix(dir, "~/") {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", err
+			}
+			dir = filepath.Join(home, dir[2:])
+		}
+		if !filepath.IsAbs(dir) && c.location != "" {
+			dir = filepath.Join(filepath.Dir(c.location), dir)
+		}
+		if IsFile(dir) {
+			return filepath.Abs(dir)
+		}
+	}
+	loc, err := findConfigFile(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(loc)
+}
+
+// canonicalPath resolves symlinks in path so the
+// same file is always identified by the same path.
+func canonicalPath(path string) string {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return path
+	}
+	return resolved
+}
+
+// isFlakeRef reports whether ref looks like a flake
+// reference rather than a local path.
+func isFlakeRef(ref string) bool {
+	return strings.Contains(ref, ":") && !filepath.IsAbs(ref)
+}
+
+// prefetchFlake copies the flake ref into the nix
+// store and returns its store path.
+func prefetchFlake(ref string) (string, error) {
+	if OfflineMode {
+		return "", ErrOfflineMode
+	}
+	command := exec.Command(NixBinary(), "flake", "prefetch", "--json", ref)
+	command.Env = os.Environ()
+	bb, err := command.Output()
+	if err != nil {
+		return "", fmt.Errorf("nix flake prefetch %s: %w", ref, err)
+	}
+	var out struct {
+		StorePath string `json:"storePath"`
+	}
+	err = json.Unmarshal(bb, &out)
+	if err != nil {
+		return "", err
+	}
+	return out.StorePath, nil
+}
+
+// clone returns a deep copy of the serialized
+// fields of the configuration.
+func (c *Config) clone() (*Config, error) {
+	bb, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	cp := &Config{}
+	err = yaml.Unmarshal(bb, cp)
+	if err != nil {
+		return nil, err
+	}
+	cp.Debug = c.Debug
+	cp.Verbose = c.Verbose
+	cp.Force = c.Force
+	cp.Quiet = c.Quiet
+	return cp, nil
+}
+
+// copyState copies the unexported state of c, which
+// clone drops, to dst.
+func (c *Config) copyState(dst *Config) {
+	dst.location = c.location
+	dst.base = c.base
+	dst.systemsKey, dst.systemsValue = c.systemsKey, c.systemsValue
+	dst.anchors = c.anchors
+	dst.recipients = c.recipients
+	dst.encrypted = c.encrypted
+	dst.keys = c.keys
+	dst.file = c.file
+	dst.mismatch = c.mismatch
+}
+
+// localLayer returns the configuration with every value
+// supplied by its base removed, so that saving it doesn't
+// copy the base into the local file, and the keys that
+// should be left out of the file for that reason.
+func (c *Config) localLayer() (*Config, keySet, error) {
+	local, err := c.clone()
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.base == nil {
+		return local, nil, nil
+	}
+	var file reflect.Value
+	if c.file != nil {
+		file = reflect.ValueOf(c.file).Elem()
+	}
+	drop := subtract(reflect.ValueOf(local).Elem(), reflect.ValueOf(c.base).Elem(), file, c.keys)
+	return local, drop, nil
+}
+
+// keySet is the tree of mapping keys present in a
+// configuration file, used to tell a scalar set to its
+// zero value apart from one that isn't set at all.
+type keySet map[string]keySet
+
+// fileKeys returns the keys present in the
+// configuration file contents bb.
+func fileKeys(bb []byte) keySet {
+	var doc yaml.Node
+	if yaml.Unmarshal(bb, &doc) != nil || len(doc.Content) == 0 {
+		return nil
+	}
+	return nodeKeys(doc.Content[0])
+}
+
+func nodeKeys(n *yaml.Node) keySet {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if n.Kind != yaml.MappingNode {
+		return keySet{}
+	}
+	keys := keySet{}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		keys[n.Content[i].Value] = nodeKeys(n.Content[i+1])
+	}
+	return keys
+}
+
+// has reports whether name is set in the file. Without a
+// file, a value that isn't zero counts as set.
+func (k keySet) has(name string, v reflect.Value) bool {
+	if k == nil {
+		return !v.IsZero()
+	}
+	_, ok := k[name]
+	return ok
+}
+
+// prune deletes the keys in drop from the
+// unmarshaled configuration file m.
+func prune(m interface{}, drop keySet) {
+	for name, sub := range drop {
+		switch mm := m.(type) {
+		case map[interface{}]interface{}:
+			if len(sub) == 0 {
+				delete(mm, name)
+			} else {
+				prune(mm[name], sub)
+			}
+		case map[string]interface{}:
+			if len(sub) == 0 {
+				delete(mm, name)
+			} else {
+				prune(mm[name], sub)
+			}
+		}
+	}
+}
+
+// serialized reports whether the struct field is
+// written to the configuration file.
+func serialized(f reflect.StructField) bool {
+	return f.IsExported() && f.Tag.Get("yaml") != "-"
+}
+
+// overlay fills dst with values from base following
+// the rules described on ResolveConfig. set holds the
+// keys of the local configuration file.
+func overlay(dst, base reflect.Value, set keySet) {
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+		if !serialized(field) {
+			continue
+		}
+		name := yamlName(field)
+		d, b := dst.Field(i), base.Field(i)
+		switch d.Kind() {
+		case reflect.Struct:
+			overlay(d, b, set[name])
+		case reflect.Slice:
+			union := reflect.MakeSlice(d.Type(), 0, b.Len()+d.Len())
+			for _, s := range []reflect.Value{b, d} {
+				for j := 0; j < s.Len(); j++ {
+					if !containsValue(union, s.Index(j)) {
+						union = reflect.Append(union, s.Index(j))
+					}
+				}
+			}
+			d.Set(union)
+		case reflect.Map:
+			if b.Len() == 0 {
+				continue
+			}
+			if d.IsNil() {
+				d.Set(reflect.MakeMap(d.Type()))
+			}
+			iter := b.MapRange()
+			for iter.Next() {
+				if !d.MapIndex(iter.Key()).IsValid() {
+					d.SetMapIndex(iter.Key(), iter.Value())
+				}
+			}
+		default:
+			if !set.has(name, d) {
+				d.Set(b)
+			}
+		}
+	}
+}
+
+// subtract clears the values in dst that are identical
+// to those in base, except for those in the local
+// configuration file: list entries in file, which may be
+// invalid if there is no file, and scalars whose keys are
+// in set. It returns the keys of the cleared scalars.
+func subtract(dst, base, file reflect.Value, set keySet) keySet {
+	drop := keySet{}
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+		if !serialized(field) {
+			continue
+		}
+		name := yamlName(field)
+		d, b := dst.Field(i), base.Field(i)
+		var f reflect.Value
+		if file.IsValid() {
+			f = file.Field(i)
+		}
+		switch d.Kind() {
+		case reflect.Struct:
+			if sub := subtract(d, b, f, set[name]); len(sub) > 0 {
+				drop[name] = sub
+			}
+		case reflect.Slice:
+			if d.IsNil() {
+				continue
+			}
+			kept := reflect.MakeSlice(d.Type(), 0, d.Len())
+			for j := 0; j < d.Len(); j++ {
+				if !containsValue(b, d.Index(j)) || (f.IsValid() && containsValue(f, d.Index(j))) {
+					kept = reflect.Append(kept, d.Index(j))
+				}
+			}
+			d.Set(kept)
+		case reflect.Map:
+			iter := b.MapRange()
+			for iter.Next() {
+				v := d.MapIndex(iter.Key())
+				if v.IsValid() && reflect.DeepEqual(v.Interface(), iter.Value().Interface()) {
+					d.SetMapIndex(iter.Key(), reflect.Value{})
+				}
+			}
+		default:
+			if _, ok := set[name]; ok {
+				continue
+			}
+			if reflect.DeepEqual(d.Interface(), b.Interface()) {
+				d.Set(reflect.Zero(d.Type()))
+				drop[name] = keySet{}
+			}
+		}
+	}
+	return drop
+}
+
+func containsValue(list, v reflect.Value) bool {
+	for i := 0; i < list.Len(); i++ {
+		if reflect.DeepEqual(list.Index(i).Interface(), v.Interface()) {
+			return true
+		}
+	}
+	return false
+}
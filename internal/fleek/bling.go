@@ -2,6 +2,7 @@ package fleek
 
 import (
 	_ "embed"
+	"sort"
 
 	"github.com/samber/lo"
 	"gopkg.in/yaml.v3"
@@ -18,13 +19,10 @@ type Bling struct {
 
 // FinalPrograms returns the list of bling programs
 // to install minus anything blocked in the config's
-// Blocklist slice. Git is also removed if BYOGit is
-// specified in the config
+// Blocklist or ExcludedPrograms slices. Git is also
+// removed if BYOGit is specified in the config
 func (b *Bling) FinalPrograms(c *Config) []string {
-	if c.BYOGit {
-		c.Blocklist = append(c.Blocklist, "git")
-	}
-	return lo.Without(b.Programs, c.Blocklist...)
+	return lo.Without(lo.Without(b.Programs, c.blocked()...), c.ExcludedPrograms...)
 }
 
 // FinalPapckages returns the list of bling packages
@@ -32,10 +30,101 @@ func (b *Bling) FinalPrograms(c *Config) []string {
 // Blocklist slice. Git is also removed if BYOGit is
 // specified in the config
 func (b *Bling) FinalPackages(c *Config) []string {
+	return lo.Without(b.Packages, c.blocked()...)
+}
+
+// blocked returns the Blocklist plus git when
+// BYOGit is set, without modifying the config.
+func (c *Config) blocked() []string {
 	if c.BYOGit {
-		c.Blocklist = append(c.Blocklist, "git")
+		return append(append([]string{}, c.Blocklist...), "git")
+	}
+	return c.Blocklist
+}
+
+// SetBling changes the bling level and saves the
+// configuration. It returns the packages the old level
+// provided that the new level doesn't, sorted. Packages
+// the user listed explicitly are kept and not reported.
+func (c *Config) SetBling(level string) ([]string, error) {
+	if c.Locked {
+		return nil, ErrConfigLocked
+	}
+	if !c.validBling(level) {
+		return nil, ErrInvalidBling
+	}
+	old, err := c.CurrentBling()
+	if err != nil {
+		return nil, err
 	}
-	return lo.Without(b.Packages, c.Blocklist...)
+	next, err := c.blingForLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	dropped := lo.Without(old.FinalPackages(c), next.FinalPackages(c)...)
+	dropped = lo.Without(dropped, c.Packages...)
+	sort.Strings(dropped)
+	c.Bling = level
+	return dropped, c.Save()
+}
+
+// DisableBlingProgram excludes a program provided by
+// the current bling level and saves the configuration.
+func (c *Config) DisableBlingProgram(name string) error {
+	if c.Locked {
+		return ErrConfigLocked
+	}
+	b, err := c.CurrentBling()
+	if err != nil {
+		return err
+	}
+	if !isValueInList(name, b.Programs) {
+		return ErrNotBlingProgram
+	}
+	if isValueInList(name, c.ExcludedPrograms) {
+		return nil
+	}
+	c.ExcludedPrograms = append(c.ExcludedPrograms, name)
+	return c.Save()
+}
+
+// EnableBlingProgram removes a program from the
+// ExcludedPrograms list and saves the configuration.
+func (c *Config) EnableBlingProgram(name string) error {
+	if c.Locked {
+		return ErrConfigLocked
+	}
+	if !isValueInList(name, c.ExcludedPrograms) {
+		return ErrProgramNotFound
+	}
+	c.ExcludedPrograms = lo.Without(c.ExcludedPrograms, name)
+	return c.Save()
+}
+
+// BlingLevelOf returns the bling level that first
+// provides pkg. Higher levels include all packages from
+// the levels below them.
+func BlingLevelOf(pkg string) (level string, ok bool) {
+	return blingLevelOf(pkg, LowPackages, DefaultPackages, HighPackages)
+}
+
+// BlingProgramLevelOf returns the bling level that first
+// provides prog. Higher levels include all programs from
+// the levels below them.
+func BlingProgramLevelOf(prog string) (level string, ok bool) {
+	return blingLevelOf(prog, LowPrograms, DefaultPrograms, HighPrograms)
+}
+
+func blingLevelOf(name string, low, dflt, high []string) (string, bool) {
+	switch {
+	case isValueInList(name, low):
+		return "low", true
+	case isValueInList(name, dflt):
+		return "default", true
+	case isValueInList(name, high):
+		return "high", true
+	}
+	return "", false
 }
 
 var (
@@ -76,6 +165,62 @@ func loadBling(bytes []byte) (*Bling, error) {
 	return &b, nil
 }
 
+// CurrentBling returns the Bling set for the
+// configured level, including custom ExtraTiers.
+func (c *Config) CurrentBling() (*Bling, error) {
+	return c.blingForLevel(c.Bling)
+}
+
+// blingForLevel is like BlingForLevel, but a level
+// named in ExtraTiers is the high set with the tier's
+// packages added.
+func (c *Config) blingForLevel(level string) (*Bling, error) {
+	extras, ok := c.ExtraTiers[level]
+	if !ok {
+		return BlingForLevel(level)
+	}
+	high, err := HighBling()
+	if err != nil {
+		return nil, err
+	}
+	b := *high
+	b.Name = level
+	b.Packages = lo.Uniq(append(append([]string{}, high.Packages...), extras...))
+	b.PackageMap = make(map[string]*Package, len(high.PackageMap)+len(extras))
+	for name, pkg := range high.PackageMap {
+		b.PackageMap[name] = pkg
+	}
+	for _, name := range extras {
+		if _, ok := b.PackageMap[name]; !ok {
+			b.PackageMap[name] = &Package{Name: name}
+		}
+	}
+	return &b, nil
+}
+
+// validBling reports whether level is a built-in
+// bling level or one of the ExtraTiers.
+func (c *Config) validBling(level string) bool {
+	_, ok := c.ExtraTiers[level]
+	return ok || isValueInList(level, blingLevels)
+}
+
+// BlingForLevel returns the Bling set for the
+// named level, falling back to the default level
+// for unknown names.
+func BlingForLevel(level string) (*Bling, error) {
+	switch level {
+	case "high":
+		return HighBling()
+	case "low":
+		return LowBling()
+	case "none":
+		return NoBling()
+	default:
+		return DefaultBling()
+	}
+}
+
 func NoBling() (*Bling, error) {
 
 	return loadBling(none)
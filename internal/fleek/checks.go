@@ -1,19 +1,166 @@
 package fleek
 
 import (
+	"bufio"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/ublue-os/fleek/fin"
+	"github.com/ublue-os/fleek/internal/envir"
+	"github.com/ublue-os/fleek/internal/xdg"
 )
 
 // CheckNix verifies that the nix
 // command is available in user's PATH
 func CheckNix() bool {
-	_, err := exec.LookPath("nix")
+	_, err := exec.LookPath(NixBinary())
 	return err == nil
 }
 
+// NixBinary returns the nix binary to run, which can be
+// overridden with the FLEEK_NIX_BIN environment variable.
+// Every nix command fleek runs uses it.
+func NixBinary() string {
+	return envir.GetValueOrDefault(envir.NixBin, "nix")
+}
+
 func SSHAuthSock() bool {
 	sock := os.Getenv("SSH_AUTH_SOCK")
 	return sock != ""
 
 }
+
+// Severity is how serious a Diagnostic is.
+type Severity int
+
+const (
+	SeverityOK Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return "ok"
+	}
+}
+
+// Diagnostic is the result of one environment check.
+// Hint describes how to fix a failed check.
+type Diagnostic struct {
+	Check    string
+	Severity Severity
+	Message  string
+	Hint     string
+}
+
+// Doctor checks the environment fleek needs: nix and
+// home-manager, the nix flakes features, the flake
+// directory and its git repository, the ~/.fleek.yml
+// symlink and the configuration file's permissions.
+// A Diagnostic is returned for every check.
+func (c *Config) Doctor() []Diagnostic {
+	var d []Diagnostic
+	if CheckNix() {
+		d = append(d, Diagnostic{Check: "nix", Message: "nix is installed"})
+	} else {
+		d = append(d, Diagnostic{Check: "nix", Severity: SeverityError, Message: "nix is not on your PATH", Hint: "install nix from https://nixos.org/download"})
+	}
+	if _, err := exec.LookPath("home-manager"); err == nil {
+		d = append(d, Diagnostic{Check: "home-manager", Message: "home-manager is installed"})
+	} else {
+		d = append(d, Diagnostic{Check: "home-manager", Severity: SeverityWarning, Message: "home-manager is not on your PATH", Hint: "run `fleek apply` to install it"})
+	}
+	if flakesEnabled() {
+		d = append(d, Diagnostic{Check: "flakes", Message: "nix-command and flakes are enabled"})
+	} else {
+		d = append(d, Diagnostic{Check: "flakes", Severity: SeverityError, Message: "nix-command and flakes are not enabled", Hint: "add `experimental-features = nix-command flakes` to " + xdg.ConfigSubpath("nix/nix.conf")})
+	}
+	dir := c.UserFlakeDir()
+	switch {
+	case !IsDir(dir):
+		d = append(d, Diagnostic{Check: "flakedir", Severity: SeverityError, Message: "flake directory " + dir + " does not exist", Hint: "run `fleek init`"})
+	// a submodule or worktree has a .git file
+	case !Exists(filepath.Join(dir, ".git")):
+		d = append(d, Diagnostic{Check: "flakedir", Severity: SeverityWarning, Message: "flake directory " + dir + " is not a git repository", Hint: "run `git init` in " + dir})
+	default:
+		d = append(d, Diagnostic{Check: "flakedir", Message: "flake directory " + dir + " is a git repository"})
+	}
+	if err := c.checkSymlink(); err != nil {
+		d = append(d, Diagnostic{Check: "symlink", Severity: SeverityError, Message: err.Error(), Hint: "remove ~/.fleek.yml and run `fleek init` again"})
+	} else {
+		d = append(d, Diagnostic{Check: "symlink", Message: "~/.fleek.yml is valid"})
+	}
+	if err := c.CheckPermissions(); err != nil {
+		d = append(d, Diagnostic{Check: "permissions", Severity: SeverityError, Message: err.Error(), Hint: "fix the ownership and permissions of the configuration file"})
+	} else {
+		d = append(d, Diagnostic{Check: "permissions", Message: "configuration file is writable"})
+	}
+	return d
+}
+
+// flakesEnabled reports whether nix has the nix-command
+// and flakes features enabled. nix is asked first; when
+// that fails, as it does without nix-command, NIX_CONFIG
+// and the user and system nix.conf files are read instead.
+func flakesEnabled() bool {
+	features, err := nixFeatures()
+	if err != nil {
+		fin.Logger.Debug("nix config show failed, reading nix.conf", fin.Logger.Args("error", err))
+		// later settings override earlier ones,
+		// like nix reads them
+		var text string
+		for _, conf := range []string{"/etc/nix/nix.conf", xdg.ConfigSubpath("nix/nix.conf")} {
+			if bb, err := os.ReadFile(conf); err == nil {
+				text += string(bb) + "\n"
+			}
+		}
+		features = parseFeatures(text + os.Getenv("NIX_CONFIG"))
+	}
+	return isValueInList("nix-command", features) && isValueInList("flakes", features)
+}
+
+// nixFeatures returns the experimental features nix has
+// enabled, from `nix config show`, or `nix show-config`
+// for nix versions before 2.20.
+func nixFeatures() ([]string, error) {
+	var err error
+	for _, args := range [][]string{{"config", "show"}, {"show-config"}} {
+		command := exec.Command(NixBinary(), args...)
+		command.Env = os.Environ()
+		var bb []byte
+		bb, err = command.Output()
+		if err == nil {
+			return parseFeatures(string(bb)), nil
+		}
+	}
+	return nil, err
+}
+
+// parseFeatures returns the experimental features set by
+// the nix.conf formatted text, where extra-experimental-features
+// adds to experimental-features.
+func parseFeatures(text string) []string {
+	var features, extra []string
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "experimental-features":
+			features = strings.Fields(value)
+		case "extra-experimental-features":
+			extra = append(extra, strings.Fields(value)...)
+		}
+	}
+	return append(features, extra...)
+}
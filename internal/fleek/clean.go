@@ -0,0 +1,249 @@
+package fleek
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+var ErrOffline = errors.New("no network connection, unable to check packages and programs")
+
+// OfflineMode disables every operation that runs git or
+// nix, or needs the network. Those operations return
+// ErrOfflineMode instead. Configuration changes still work.
+var OfflineMode bool
+
+var ErrOfflineMode = errors.New("offline mode is enabled, skipping git and nix commands")
+
+// online reports whether the nix binary cache is reachable.
+func online() bool {
+	conn, err := net.DialTimeout("tcp", "cache.nixos.org:443", 5*time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Clean removes packages that don't exist in the tracked
+// nixpkgs and programs that aren't home-manager modules,
+// then saves the configuration. It returns the removed
+// entries. Clean requires a network connection, and returns
+// ErrOffline without changing anything when there isn't one.
+func (c *Config) Clean() (removed []string, err error) {
+	if c.Locked {
+		return nil, ErrConfigLocked
+	}
+	if OfflineMode {
+		return nil, ErrOfflineMode
+	}
+	if !online() {
+		return nil, ErrOffline
+	}
+	missing, err := c.missingPackages()
+	if err != nil {
+		return nil, fmt.Errorf("checking packages: %w", err)
+	}
+	modules, err := c.programModules()
+	if err != nil {
+		return nil, fmt.Errorf("checking programs: %w", err)
+	}
+	var packages []string
+	for _, p := range c.Packages {
+		if isValueInList(p, missing) {
+			removed = append(removed, p)
+			continue
+		}
+		packages = append(packages, p)
+	}
+	var programs []string
+	for _, p := range c.Programs {
+		if !isValueInList(p, modules) {
+			removed = append(removed, p)
+			continue
+		}
+		programs = append(programs, p)
+	}
+	if len(removed) == 0 {
+		return removed, nil
+	}
+	c.Packages = packages
+	c.Programs = programs
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return removed, c.Save()
+}
+
+// Dedupe removes duplicate entries from the package,
+// program and path lists, keeping the first occurrence,
+// then saves the configuration. It returns the number
+// of entries removed.
+func (c *Config) Dedupe() (removed int, err error) {
+	if c.Locked {
+		return 0, ErrConfigLocked
+	}
+	packages := lo.Uniq(c.Packages)
+	programs := lo.Uniq(c.Programs)
+	paths := lo.Uniq(c.Paths)
+	removed = len(c.Packages) - len(packages) +
+		len(c.Programs) - len(programs) +
+		len(c.Paths) - len(paths)
+	if removed == 0 {
+		return 0, nil
+	}
+	c.Packages = packages
+	c.Programs = programs
+	c.Paths = paths
+	err = c.Validate()
+	if err != nil {
+		return 0, err
+	}
+	return removed, c.Save()
+}
+
+// shellBuiltins are bash and zsh builtins and keywords
+// an alias might start with. Builtins of either shell are
+// kept, since aliases are shared when the shell changes.
+var shellBuiltins = []string{
+	// both shells
+	".", ":", "[", "alias", "bg", "builtin", "cd", "command", "declare",
+	"dirs", "disown", "echo", "eval", "exec", "exit", "export", "false", "fc",
+	"fg", "for", "getopts", "hash", "history", "if", "jobs", "kill", "let",
+	"local", "popd", "printf", "pushd", "pwd", "read", "readonly", "return",
+	"set", "shift", "source", "test", "time", "trap", "true", "type",
+	"typeset", "ulimit", "umask", "unalias", "unset", "until", "wait", "while",
+	// bash
+	"bind", "caller", "compgen", "complete", "compopt", "enable", "help",
+	"logout", "mapfile", "readarray", "shopt", "suspend", "times",
+	// zsh
+	"autoload", "bindkey", "compdef", "emulate", "functions", "noglob",
+	"print", "rehash", "setopt", "unsetopt", "whence", "zle", "zmodload",
+	"zstyle",
+}
+
+// PruneAliases removes aliases whose command can't be run,
+// then saves the configuration. It returns the removed
+// aliases. An alias is only removed when its first word is
+// a plain command name that isn't on the PATH, a shell
+// builtin, another alias, or a configured package or
+// program, or a path to a file that doesn't exist.
+func (c *Config) PruneAliases() (removed []string, err error) {
+	if c.Locked {
+		return nil, ErrConfigLocked
+	}
+	// configured packages and programs may not
+	// be installed yet, so they're never dead
+	known, _ := c.EffectivePackages()
+	known = append(known, c.Programs...)
+	if b, err := c.CurrentBling(); err == nil {
+		known = append(known, b.FinalPrograms(c)...)
+	}
+	for name, command := range c.Aliases {
+		if !c.deadAlias(command, known) {
+			continue
+		}
+		removed = append(removed, name)
+	}
+	if len(removed) == 0 {
+		return removed, nil
+	}
+	sort.Strings(removed)
+	for _, name := range removed {
+		delete(c.Aliases, name)
+	}
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return removed, c.Save()
+}
+
+func (c *Config) deadAlias(command string, known []string) bool {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return false
+	}
+	first := fields[0]
+	// anything using expansion, quoting or
+	// assignments can't be checked safely
+	if strings.ContainsAny(first, "$`(){}'\"=*?") {
+		return false
+	}
+	if strings.HasPrefix(first, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return false
+		}
+		first = filepath.Join(home, first[2:])
+	}
+	if strings.Contains(first, "/") {
+		return !Exists(first)
+	}
+	if isValueInList(first, shellBuiltins) || isValueInList(first, known) {
+		return false
+	}
+	if _, ok := c.Aliases[first]; ok {
+		return false
+	}
+	if _, ok := systemAliases[first]; ok {
+		return false
+	}
+	_, err := exec.LookPath(first)
+	return err != nil
+}
+
+// missingPackages returns the configured packages that
+// don't exist in the nixpkgs branch the config tracks.
+func (c *Config) missingPackages() ([]string, error) {
+	if len(c.Packages) == 0 {
+		return nil, nil
+	}
+	names := make([]string, len(c.Packages))
+	for i, p := range c.Packages {
+		names[i] = strconv.Quote(p)
+	}
+	apply := "pkgs: builtins.filter (n: !(pkgs.lib.hasAttrByPath (pkgs.lib.splitString \".\" n) pkgs)) [ " + strings.Join(names, " ") + " ]"
+	installable := "github:nixos/nixpkgs/" + c.Tracks() + "#legacyPackages." + Runtime()
+	var missing []string
+	err := nixEvalJSON(&missing, "", installable, "--apply", apply)
+	return missing, err
+}
+
+// programModules returns the names of the home-manager
+// program modules available to the current system.
+func (c *Config) programModules() ([]string, error) {
+	sys, err := c.CurrentSystem()
+	if err != nil {
+		return nil, err
+	}
+	installable := fmt.Sprintf(".#homeConfigurations.\"%s@%s\".options.programs", sys.Username, sys.Hostname)
+	var modules []string
+	err = nixEvalJSON(&modules, c.UserFlakeDir(), installable, "--apply", "builtins.attrNames")
+	return modules, err
+}
+
+// nixEvalJSON runs `nix eval --json` in dir and
+// unmarshals the result into v.
+func nixEvalJSON(v interface{}, dir string, args ...string) error {
+	command := exec.Command(NixBinary(), append([]string{"eval", "--json"}, args...)...)
+	command.Dir = dir
+	command.Env = os.Environ()
+	command.Stderr = os.Stderr
+	bb, err := command.Output()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bb, v)
+}
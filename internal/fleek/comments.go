@@ -0,0 +1,134 @@
+package fleek
+
+import (
+	"github.com/ublue-os/fleek/fin"
+	"gopkg.in/yaml.v3"
+)
+
+// systemsComments returns the `systems` key and value
+// nodes from a parsed configuration file, so the comments
+// attached to them can be restored when it's saved.
+func systemsComments(bb []byte) (key *yaml.Node, value *yaml.Node) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(bb, &doc); err != nil {
+		return nil, nil
+	}
+	return systemsNodes(&doc)
+}
+
+// systemsNodes finds the `systems` key and its value
+// in a document or mapping node.
+func systemsNodes(n *yaml.Node) (key *yaml.Node, value *yaml.Node) {
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	if n.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == "systems" {
+			return n.Content[i], n.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// restoreSystemsComments copies the comments saved when
+// the configuration was read onto the `systems` block of
+// root. Entries are matched by username and hostname, so
+// comments follow a system even if the list is reordered.
+func (c *Config) restoreSystemsComments(root *yaml.Node) {
+	if c.systemsKey == nil {
+		return
+	}
+	key, value := systemsNodes(root)
+	if key == nil {
+		return
+	}
+	copyComments(key, c.systemsKey)
+	saved := c.systemsValue
+	copyNodeComments(value, saved)
+	if value.Kind != yaml.SequenceNode || saved.Kind != yaml.SequenceNode {
+		return
+	}
+	entries := make(map[string]*yaml.Node, len(saved.Content))
+	for _, entry := range saved.Content {
+		entries[systemKey(entry)] = entry
+	}
+	for _, entry := range value.Content {
+		if old, ok := entries[systemKey(entry)]; ok {
+			copyComments(entry, old)
+		}
+	}
+}
+
+// systemKey identifies a systems entry by its
+// username and hostname.
+func systemKey(n *yaml.Node) string {
+	var sys System
+	if err := n.Decode(&sys); err != nil {
+		return ""
+	}
+	return sys.Username + "@" + sys.Hostname
+}
+
+// copyComments copies the comments from src onto dst,
+// descending into mapping keys and sequence items.
+func copyComments(dst, src *yaml.Node) {
+	copyNodeComments(dst, src)
+	switch {
+	case dst.Kind == yaml.MappingNode && src.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(dst.Content); i += 2 {
+			for j := 0; j+1 < len(src.Content); j += 2 {
+				if dst.Content[i].Value == src.Content[j].Value {
+					copyNodeComments(dst.Content[i], src.Content[j])
+					copyComments(dst.Content[i+1], src.Content[j+1])
+					break
+				}
+			}
+		}
+	case dst.Kind == yaml.SequenceNode && src.Kind == yaml.SequenceNode:
+		for i := 0; i < len(dst.Content) && i < len(src.Content); i++ {
+			copyComments(dst.Content[i], src.Content[i])
+		}
+	}
+}
+
+func copyNodeComments(dst, src *yaml.Node) {
+	dst.HeadComment = src.HeadComment
+	dst.LineComment = src.LineComment
+	dst.FootComment = src.FootComment
+}
+
+// usesAnchors reports whether a parsed configuration
+// file defines any anchors or aliases.
+func usesAnchors(bb []byte) bool {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(bb, &doc); err != nil {
+		return false
+	}
+	return hasAnchors(&doc)
+}
+
+func hasAnchors(n *yaml.Node) bool {
+	if n.Anchor != "" || n.Kind == yaml.AliasNode {
+		return true
+	}
+	for _, child := range n.Content {
+		if hasAnchors(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// warnAnchors warns that saving to file expands the
+// anchors and aliases it was read with. The warning is
+// only logged once, the saved file no longer has them.
+func (c *Config) warnAnchors(file string) {
+	if !c.anchors {
+		return
+	}
+	fin.Logger.Warn("fleek.yml: anchors and aliases are expanded when the configuration is saved", fin.Logger.Args("file", file))
+	c.anchors = false
+}
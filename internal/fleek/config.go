@@ -1,17 +1,22 @@
 package fleek
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"strings"
 
 	"github.com/hashicorp/go-version"
+	"github.com/samber/lo"
 	"github.com/ublue-os/fleek/fin"
 	"github.com/ublue-os/fleek/internal/cmdutil"
 	"github.com/ublue-os/fleek/internal/ux"
@@ -23,6 +28,7 @@ var (
 	operatingSystems = []string{"linux", "darwin"}
 	architectures    = []string{"aarch64", "x86_64"}
 	shells           = []string{"bash", "zsh"}
+	secretFormats    = []string{".yaml", ".yml", ".json", ".env", ".ini"}
 	blingLevels      = []string{"none", "low", "default", "high"}
 	LowPackages      = []string{"htop", "git", "github-cli", "glab"}
 	DefaultPackages  = []string{"fzf", "ripgrep", "vscode", "just"}
@@ -32,6 +38,14 @@ var (
 	HighPrograms     = []string{"eza", "bat", "atuin", "zoxide"}
 )
 
+// LinuxHomeBase and DarwinHomeBase are the directories
+// that contain user home directories when a system doesn't
+// set its own home. Override them for nonstandard layouts.
+var (
+	LinuxHomeBase  = "/home"
+	DarwinHomeBase = "/Users"
+)
+
 var systemAliases = map[string]string{
 	"update-fleek":         "nix run https://getfleek.dev/latest.tar.gz -- update",
 	"latest-fleek-version": "nix run https://getfleek.dev/latest.tar.gz -- version",
@@ -49,17 +63,36 @@ type Config struct {
 	Unfree     bool   `yaml:"unfree"`
 	// bash or zsh
 	Shell string `yaml:"shell"`
-	// low, default, high
+	// low, default, high or an ExtraTiers name
 	Bling    string              `yaml:"bling"`
 	Name     string              `yaml:"name"`
 	Overlays map[string]*Overlay `yaml:",flow"`
 	Packages []string            `yaml:",flow"`
 	Programs []string            `yaml:",flow"`
+	// ExtraTiers are custom bling levels, each the
+	// high level plus the listed packages
+	ExtraTiers map[string][]string `yaml:"extra_tiers,omitempty"`
+	// packages exposed as flake apps for `nix run`
+	// instead of being installed
+	Apps []string `yaml:"apps,flow"`
 	// issue 211, remove or block bling packages
-	Blocklist []string          `yaml:"blocklist,flow"`
-	Aliases   map[string]string `yaml:",flow"`
-	Paths     []string          `yaml:"paths"`
-	Ejected   bool              `yaml:"ejected"`
+	Blocklist []string `yaml:"blocklist,flow"`
+	// packages left out on a nix system double,
+	// like aarch64-darwin
+	ExcludePackages map[string][]string `yaml:"exclude_packages,omitempty"`
+	// bling programs that won't be configured
+	ExcludedPrograms []string          `yaml:"excluded_programs,flow"`
+	Aliases          map[string]string `yaml:",flow"`
+	// aliases only added to the named shell
+	ShellAliases map[string]map[string]string `yaml:"shell_aliases"`
+	// zsh plugins, either oh-my-zsh plugin names
+	// or zplug repositories in the form owner/repo
+	ShellPlugins []string `yaml:"shell_plugins"`
+	Paths        []string `yaml:"paths"`
+	// ManagePaths set to false leaves PATH alone, Paths
+	// are kept but not added to the session path
+	ManagePaths *bool `yaml:"manage_paths,omitempty"`
+	Ejected     bool  `yaml:"ejected"`
 	// issue 200 - disable any git integration
 	BYOGit      bool      `yaml:"byo_git"`
 	Systems     []*System `yaml:",flow"`
@@ -68,6 +101,58 @@ type Config struct {
 	Track       string    `yaml:"track"`
 	AllowBroken bool      `yaml:"allow_broken"`
 	AutoGC      bool      `yaml:"auto_gc"`
+	// retry apply with --impure when pure
+	// evaluation fails
+	AllowImpure bool `yaml:"allow_impure"`
+	// Locked prevents any changes to the configuration
+	// file until Unlock is called
+	Locked bool `yaml:"locked"`
+	// Secrets maps a sops-nix secret name to its
+	// encrypted file, relative to the flake directory
+	Secrets map[string]string `yaml:"secrets"`
+	// Base is a path or flake reference to another
+	// fleek configuration this one is layered on top of
+	Base string `yaml:"base"`
+	// StateVersion is the default home-manager
+	// stateVersion for systems that don't set one
+	StateVersion string `yaml:"state_version"`
+	// PackageSets are flake references whose default
+	// package is added to every system
+	PackageSets []string `yaml:"package_sets"`
+	// Modules are home-manager modules to import, either
+	// flake references exporting homeManagerModules.default
+	// or paths relative to the flake directory
+	Modules []string `yaml:"modules"`
+	// Workspaces maps a workspace name to another flake
+	// directory, relative to $HOME, used when it's active
+	Workspaces map[string]string `yaml:"workspaces"`
+	// Workspace is the active workspace, empty for FlakeDir
+	Workspace string `yaml:"workspace"`
+
+	// location is the file the config was read from
+	location string
+	// base is the resolved Base configuration
+	base *Config
+	// the `systems` block as it was read, used
+	// to keep its comments when saving
+	systemsKey   *yaml.Node
+	systemsValue *yaml.Node
+	// the file used anchors or aliases, which
+	// are expanded when it's saved
+	anchors bool
+	// age recipients the configuration file is
+	// encrypted to, if it's encrypted
+	recipients []string
+	// the file was encrypted when it was read, Save
+	// refuses to write it in plain text
+	encrypted bool
+	// keys present in the configuration file
+	keys keySet
+	// the configuration as read from its file, before
+	// the Base configuration was layered under it
+	file *Config
+	// set by ReadConfig, see FlakeDirMismatch
+	mismatch error
 }
 
 func Levels() []string {
@@ -88,6 +173,17 @@ type System struct {
 	OS       string `yaml:"os"`
 	Home     string `yaml:"home"`
 	User     *User  `yaml:"user"`
+	// home-manager stateVersion, overrides
+	// the configuration default
+	StateVersion string `yaml:"state_version"`
+	// Tags label the system's role, like server or laptop
+	Tags []string `yaml:"tags,flow"`
+	// Files maps a target path under home to a source
+	// file in the flake directory
+	Files map[string]string `yaml:"files,omitempty"`
+	// Specialisations maps a home-manager specialisation
+	// name to the extra packages it installs
+	Specialisations map[string][]string `yaml:"specialisations,omitempty"`
 }
 
 type User struct {
@@ -107,11 +203,20 @@ func (u User) HomeDir(s System) string {
 	if s.Home != "" {
 		return s.Home
 	}
-	base := "/home"
+	base := LinuxHomeBase
 	if s.OS == "darwin" {
-		base = "/Users"
+		base = DarwinHomeBase
+	}
+	home := base + "/" + u.Username
+	// WSL home directories don't always follow the
+	// standard layout, so trust $HOME for the local system
+	if s.OS == "linux" && isWSL() && s.isLocal() {
+		env := os.Getenv("HOME")
+		if env != "" && env != home {
+			return env
+		}
 	}
-	return base + "/" + u.Username
+	return home
 }
 
 func NewSystem() (*System, error) {
@@ -131,9 +236,38 @@ func NewSystem() (*System, error) {
 	}, nil
 }
 
+// NewSystemFor is like NewSystem for a machine other than
+// this one, so a remote host's system can be added from
+// anywhere. The arch and os are checked against the
+// supported architectures and operating systems.
+func NewSystemFor(hostname, username, arch, os, name, email string) (*System, error) {
+	sys := &System{
+		Hostname: hostname,
+		Username: username,
+		Arch:     arch,
+		OS:       os,
+		User: &User{
+			Username: username,
+			Name:     name,
+			Email:    email,
+		},
+	}
+	err := sys.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return sys, nil
+}
+
 // CollectGarbage runs nix-collect-garbage
 func CollectGarbage() error {
-	command := cmdutil.CommandTTY("nix-collect-garbage", "-d")
+	return CollectGarbageContext(context.Background())
+}
+
+// CollectGarbageContext is like CollectGarbage but
+// the command is cancelled when ctx is done.
+func CollectGarbageContext(ctx context.Context) error {
+	command := cmdutil.CommandTTYContext(ctx, "nix-collect-garbage", "-d")
 	command.Stderr = io.Discard
 	command.Stdout = io.Discard
 	command.Env = os.Environ()
@@ -270,14 +404,75 @@ func NewUser() (*User, error) {
 	return user, nil
 }
 
+// DetectUser is like NewUser but never prompts. The name,
+// email and ssh keys come from the FLEEK_USER_ environment
+// variables, falling back to the account's full name, the
+// global git email and ~/.ssh/id_ed25519 when it exists.
+func DetectUser() (*User, error) {
+	uname, err := Username()
+	if err != nil {
+		return nil, err
+	}
+	user := &User{
+		Username:          uname,
+		Name:              os.Getenv("FLEEK_USER_NAME"),
+		Email:             os.Getenv("FLEEK_USER_EMAIL"),
+		SSHPublicKeyFile:  os.Getenv("FLEEK_USER_PUBKEY"),
+		SSHPrivateKeyFile: os.Getenv("FLEEK_USER_PRIVKEY"),
+	}
+	if user.Name == "" {
+		name, err := Name()
+		if err != nil {
+			return nil, err
+		}
+		user.Name = strings.TrimSpace(name)
+	}
+	if user.Email == "" {
+		bb, err := exec.Command("git", "config", "--global", "user.email").Output()
+		if err == nil {
+			user.Email = strings.TrimSpace(string(bb))
+		}
+	}
+	if user.SSHPublicKeyFile == "" && user.SSHPrivateKeyFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		if Exists(filepath.Join(home, ".ssh", "id_ed25519.pub")) {
+			user.SSHPrivateKeyFile = filepath.Join("~", ".ssh", "id_ed25519")
+			user.SSHPublicKeyFile = filepath.Join("~", ".ssh", "id_ed25519.pub")
+		}
+	}
+	return user, nil
+}
+
 var (
 	ErrMissingFlakeDir        = errors.New("fleek.yml: missing `flakedir`")
 	ErrInvalidShell           = errors.New("fleek.yml: invalid shell, valid shells are: " + strings.Join(shells, ", "))
-	ErrInvalidBling           = errors.New("fleek.yml: invalid bling level, valid levels are: " + strings.Join(blingLevels, ", "))
+	ErrInvalidBling           = errors.New("fleek.yml: invalid bling level, valid levels are: " + strings.Join(blingLevels, ", ") + " or an extra_tiers name")
+	ErrInvalidBlingTier       = errors.New("fleek.yml: invalid extra_tiers name, use letters, numbers, `-` and `_` and not a built-in level")
 	ErrorInvalidArch          = errors.New("fleek.yml: invalid architecture, valid architectures are: " + strings.Join(architectures, ", "))
 	ErrInvalidOperatingSystem = errors.New("fleek.yml: invalid OS, valid operating systems are: " + strings.Join(operatingSystems, ", "))
 	ErrPackageNotFound        = errors.New("package not found in configuration file")
 	ErrProgramNotFound        = errors.New("program not found in configuration file")
+	ErrFlakeDirMismatch       = errors.New("fleek.yml: configuration file is not in the configured flakedir")
+	ErrInvalidStateVersion    = errors.New("fleek.yml: invalid state_version, expected a home-manager release like 24.05 or 24.11")
+	ErrInvalidPackageSet      = errors.New("fleek.yml: invalid package set, expected a flake reference like github:owner/repo")
+	ErrAppIsPackage           = errors.New("fleek.yml: apps can't also be listed in packages")
+	ErrInvalidSystemDouble    = errors.New("fleek.yml: invalid exclude_packages system, expected an arch-os pair like aarch64-darwin")
+	ErrShellPlugins           = errors.New("fleek.yml: shell_plugins are only supported with the zsh shell")
+	ErrInvalidWorkspace       = errors.New("fleek.yml: invalid workspace name, use letters, numbers, `-` and `_`")
+	ErrWorkspaceNotFound      = errors.New("workspace not found in configuration file")
+	ErrInvalidModule          = errors.New("fleek.yml: invalid module, expected a flake reference or an existing path")
+	ErrSecretNotFound         = errors.New("fleek.yml: secret file not found")
+	ErrFileNotFound           = errors.New("fleek.yml: system file not found")
+	ErrInvalidSecretFormat    = errors.New("fleek.yml: invalid secret file, valid extensions are: " + strings.Join(secretFormats, ", "))
+	ErrAliasNotFound          = errors.New("alias not found in configuration file")
+	ErrConfigLocked           = errors.New("fleek.yml: configuration is locked")
+	ErrInvalidPackageName     = errors.New("invalid package name")
+	ErrInvalidProgramName     = errors.New("invalid program name")
+	ErrInvalidSpecialisation  = errors.New("fleek.yml: invalid specialisation name, use letters, numbers, `-` and `_`")
+	ErrNotBlingProgram        = errors.New("program is not provided by the current bling level")
 )
 
 func (c *Config) Tracks() string {
@@ -287,25 +482,283 @@ func (c *Config) Tracks() string {
 	return "nixos-unstable"
 }
 func (c *Config) Validate() error {
+	if errs := c.validationErrors(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// validationErrors returns every problem with the
+// configuration, in the order Validate checks them.
+func (c *Config) validationErrors() []error {
+	return c.validationErrorsIn(c.UserFlakeDir())
+}
+
+// validationErrorsIn is validationErrors with relative
+// secret, module and system file paths resolved against dir.
+func (c *Config) validationErrorsIn(dir string) []error {
+	var errs []error
 	if c.FlakeDir == "" {
-		return ErrMissingFlakeDir
+		errs = append(errs, ErrMissingFlakeDir)
 	}
 	if !isValueInList(c.Shell, shells) {
-		return ErrInvalidShell
+		errs = append(errs, ErrInvalidShell)
 	}
-	if !isValueInList(c.Bling, blingLevels) {
-		return ErrInvalidBling
+	if !c.validBling(c.Bling) {
+		errs = append(errs, ErrInvalidBling)
+	}
+	for tier, packs := range c.ExtraTiers {
+		if isValueInList(tier, blingLevels) || !identifierName.MatchString(tier) {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrInvalidBlingTier, tier))
+		}
+		for _, p := range packs {
+			if !validName(p) {
+				errs = append(errs, fmt.Errorf("%w: %s: %q", ErrInvalidPackageName, tier, p))
+			}
+		}
 	}
 	for _, sys := range c.Systems {
-		if !isValueInList(sys.Arch, architectures) {
-			return ErrorInvalidArch
+		if err := sys.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+		for _, src := range sys.Files {
+			if !Exists(flakeRelPath(dir, src)) {
+				errs = append(errs, fmt.Errorf("%w: %s", ErrFileNotFound, src))
+			}
+		}
+	}
+	if c.StateVersion != "" && !stateVersion.MatchString(c.StateVersion) {
+		errs = append(errs, ErrInvalidStateVersion)
+	}
+	for shell := range c.ShellAliases {
+		if !isValueInList(shell, shells) {
+			errs = append(errs, fmt.Errorf("%w: shell_aliases: %s", ErrInvalidShell, shell))
 		}
+	}
+	for name := range c.Workspaces {
+		if !identifierName.MatchString(name) {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrInvalidWorkspace, name))
+		}
+	}
+	if _, ok := c.Workspaces[c.Workspace]; c.Workspace != "" && !ok {
+		errs = append(errs, fmt.Errorf("%w: %s", ErrWorkspaceNotFound, c.Workspace))
+	}
+	for _, app := range c.Apps {
+		if isValueInList(app, c.Packages) {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrAppIsPackage, app))
+		}
+	}
+	for double, packs := range c.ExcludePackages {
+		arch, opsys, ok := strings.Cut(double, "-")
+		if !ok || !isValueInList(arch, architectures) || !isValueInList(opsys, operatingSystems) {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrInvalidSystemDouble, double))
+		}
+		for _, p := range packs {
+			if !validName(p) {
+				errs = append(errs, fmt.Errorf("%w: %s: %q", ErrInvalidPackageName, double, p))
+			}
+		}
+	}
+	if len(c.ShellPlugins) > 0 && c.Shell != "zsh" {
+		errs = append(errs, ErrShellPlugins)
+	}
+	for _, ref := range c.PackageSets {
+		if !IsValidFlakeRef(ref) {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrInvalidPackageSet, ref))
+		}
+	}
+	for _, module := range c.Modules {
+		if isFlakeRef(module) {
+			if !IsValidFlakeRef(module) {
+				errs = append(errs, fmt.Errorf("%w: %s", ErrInvalidModule, module))
+			}
+		} else if !Exists(flakeRelPath(dir, module)) {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrInvalidModule, module))
+		}
+	}
+	for name, file := range c.Secrets {
+		if !isValueInList(filepath.Ext(file), secretFormats) {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrInvalidSecretFormat, name))
+		}
+		if !Exists(flakeRelPath(dir, file)) {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrSecretNotFound, file))
+		}
+	}
+	return errs
+}
+
+// Warnings returns the problems with the configuration
+// that don't fail validation: PathWarnings, ProgramWarnings
+// and PackageConflicts. Validate doesn't log them, the CLI
+// does once per command.
+func (c *Config) Warnings() []string {
+	warnings := append(c.PathWarnings(), c.ProgramWarnings()...)
+	for _, pair := range c.PackageConflicts() {
+		warnings = append(warnings, fmt.Sprintf("fleek.yml: packages %s and %s conflict, keep only one", pair[0], pair[1]))
+	}
+	return warnings
+}
 
-		if !isValueInList(sys.OS, operatingSystems) {
-			return ErrInvalidOperatingSystem
+// PathsEnabled reports whether Paths are added to the
+// session path, which is the default when ManagePaths
+// isn't set.
+func (c *Config) PathsEnabled() bool {
+	return c.ManagePaths == nil || *c.ManagePaths
+}
+
+// PathWarnings returns a warning for each entry in Paths
+// that starts with a bare `~`, which isn't expanded by the
+// shell in every context. These don't fail validation.
+func (c *Config) PathWarnings() []string {
+	var warnings []string
+	for _, p := range c.Paths {
+		if p == "~" || strings.HasPrefix(p, "~/") {
+			warnings = append(warnings, fmt.Sprintf("fleek.yml: path %s uses `~`, use %s instead", p, "$HOME"+strings.TrimPrefix(p, "~")))
 		}
 	}
-	return nil
+	return warnings
+}
+
+// stateVersion matches the home-manager releases, from
+// 18.09 on. Since 21.05 they're YY.05 and YY.11, so new
+// releases are accepted without updating fleek.
+var stateVersion = regexp.MustCompile(`^(18\.09|19\.0[39]|20\.0[39]|21\.03|(2[1-9]|[3-9][0-9])\.(05|11))$`)
+
+// identifierName matches the names of workspaces, extra
+// bling tiers and specialisations, which are used as nix
+// attribute names and on the command line.
+var identifierName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// UseWorkspace makes the named workspace active and saves
+// the configuration. An empty name switches back to
+// FlakeDir. The workspace's flake directory must exist.
+func (c *Config) UseWorkspace(name string) error {
+	if c.Locked {
+		return ErrConfigLocked
+	}
+	if name != "" {
+		dir, ok := c.Workspaces[name]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrWorkspaceNotFound, name)
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		if !IsDir(filepath.Join(home, dir)) {
+			return fmt.Errorf("%w: %s", ErrNoFlakeDir, filepath.Join(home, dir))
+		}
+	}
+	c.Workspace = name
+	err := c.Validate()
+	if err != nil {
+		return err
+	}
+	return c.Save()
+}
+
+// linuxOnlyPrograms are home-manager program modules
+// that don't work on darwin.
+var linuxOnlyPrograms = []string{
+	"foot", "fuzzel", "gnome-terminal", "i3status", "i3status-rust",
+	"rofi", "swaylock", "tofi", "waybar", "wlogout", "wofi",
+}
+
+// ProgramWarnings returns a warning for each program that
+// is also listed in packages, since the program module
+// supersedes the bare package, and for each linux-only
+// program configured while a darwin system is listed.
+// These don't fail validation.
+func (c *Config) ProgramWarnings() []string {
+	var warnings []string
+	for _, p := range c.Programs {
+		if isValueInList(p, c.Packages) {
+			warnings = append(warnings, fmt.Sprintf("fleek.yml: %s is listed in both packages and programs, remove it from packages and keep the program", p))
+		}
+	}
+	for _, sys := range c.Systems {
+		if sys.OS != "darwin" {
+			continue
+		}
+		for _, p := range c.Programs {
+			if isValueInList(p, linuxOnlyPrograms) {
+				warnings = append(warnings, fmt.Sprintf("fleek.yml: program %s is linux only and won't build on %s", p, sys.Hostname))
+			}
+		}
+	}
+	return warnings
+}
+
+// knownConflicts are pairs of packages that install files
+// at the same path, which home-manager can't activate
+// together.
+var knownConflicts = [][2]string{
+	{"busybox", "coreutils"},
+	{"clang", "gcc"},
+	{"cronie", "fcron"},
+	{"emacs", "emacs-nox"},
+	{"netcat-gnu", "netcat-openbsd"},
+	{"openssh", "openssh_hpn"},
+	{"vim", "vim-full"},
+}
+
+// PackageConflicts returns the pairs from knownConflicts
+// that are both in the effective packages or programs.
+func (c *Config) PackageConflicts() [][2]string {
+	installed, _ := c.EffectivePackages()
+	installed = append(installed, c.Programs...)
+	var conflicts [][2]string
+	for _, pair := range knownConflicts {
+		if isValueInList(pair[0], installed) && isValueInList(pair[1], installed) {
+			conflicts = append(conflicts, pair)
+		}
+	}
+	return conflicts
+}
+
+// flakeRelPath resolves a secret, module or system file
+// relative to the flake directory dir.
+func flakeRelPath(dir, file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(dir, file)
+}
+
+// NixSecrets returns the configured secrets with
+// each file converted to a nix path expression.
+func (c *Config) NixSecrets() map[string]string {
+	secrets := make(map[string]string, len(c.Secrets))
+	for name, file := range c.Secrets {
+		if filepath.IsAbs(file) {
+			secrets[name] = file
+		} else {
+			secrets[name] = "./" + filepath.ToSlash(filepath.Clean(file))
+		}
+	}
+	return secrets
+}
+
+// ModuleRefs returns the modules that are flake references.
+func (c *Config) ModuleRefs() []string {
+	return lo.Filter(c.Modules, func(m string, _ int) bool { return isFlakeRef(m) })
+}
+
+// ModulePaths returns the modules that are local files,
+// converted to nix path expressions.
+func (c *Config) ModulePaths() []string {
+	var paths []string
+	for _, m := range c.Modules {
+		if isFlakeRef(m) {
+			continue
+		}
+		if filepath.IsAbs(m) {
+			paths = append(paths, m)
+		} else {
+			paths = append(paths, "./"+filepath.ToSlash(filepath.Clean(m)))
+		}
+	}
+	return paths
 }
 
 func isValueInList(value string, list []string) bool {
@@ -334,7 +787,30 @@ func (c *Config) UniqueSystems() []string {
 
 }
 
+// StateVersionFor returns the home-manager stateVersion
+// for sys, falling back to the configuration default.
+func (c *Config) StateVersionFor(sys *System) string {
+	if sys.StateVersion != "" {
+		return sys.StateVersion
+	}
+	if c.StateVersion != "" {
+		return c.StateVersion
+	}
+	return "22.11"
+}
+
 func (c *Config) UserFlakeDir() string {
+	if dir, ok := c.Workspaces[c.Workspace]; ok && c.Workspace != "" {
+		home, _ := os.UserHomeDir()
+		return filepath.Join(home, dir)
+	}
+	return c.configFlakeDir()
+}
+
+// configFlakeDir returns the flake directory holding the
+// configuration file, which doesn't change with the
+// active workspace.
+func (c *Config) configFlakeDir() string {
 	home, _ := os.UserHomeDir()
 	// if for some reason the flakedir key is
 	// missing, try loading the default location
@@ -344,23 +820,24 @@ func (c *Config) UserFlakeDir() string {
 	return filepath.Join(home, c.FlakeDir)
 }
 
-func (c *Config) UserForSystem(system string) *User {
-	var userSystem *System
-	for _, sys := range c.Systems {
-		if sys.Hostname == system {
-			userSystem = sys
-		}
+// UserForSystem returns the user configured for the
+// host, or nil if it has none. An error is returned
+// when there's no system for the host.
+func (c *Config) UserForSystem(system string) (*User, error) {
+	userSystem, err := c.System(system)
+	if err != nil {
+		return nil, err
 	}
 	if userSystem.User != nil {
-		return userSystem.User
+		return userSystem.User, nil
 	}
 	// legacy unmigrated users
 	for _, u := range c.Users {
 		if u.Username == userSystem.Username {
-			return u
+			return u, nil
 		}
 	}
-	return nil
+	return nil, nil
 }
 
 func (c *Config) AllAliases() map[string]string {
@@ -370,7 +847,102 @@ func (c *Config) AllAliases() map[string]string {
 	return c.Aliases
 }
 
+// ListAliases returns the configured aliases and the
+// aliases fleek adds itself, sorted by name.
+func (c *Config) ListAliases() []Alias {
+	all := make(map[string]string, len(c.Aliases)+len(systemAliases))
+	for k, v := range systemAliases {
+		all[k] = v
+	}
+	for k, v := range c.Aliases {
+		all[k] = v
+	}
+	aliases := make([]Alias, 0, len(all))
+	for _, name := range lo.Keys(all) {
+		aliases = append(aliases, Alias{Key: name, Value: all[name]})
+	}
+	sort.Slice(aliases, func(i, j int) bool { return aliases[i].Key < aliases[j].Key })
+	return aliases
+}
+
+// OhMyZshPlugins returns the shell plugins that
+// are oh-my-zsh plugin names.
+func (c *Config) OhMyZshPlugins() []string {
+	return lo.Filter(c.ShellPlugins, func(p string, _ int) bool { return !strings.Contains(p, "/") })
+}
+
+// ZplugPlugins returns the shell plugins that
+// are zplug repositories.
+func (c *Config) ZplugPlugins() []string {
+	return lo.Filter(c.ShellPlugins, func(p string, _ int) bool { return strings.Contains(p, "/") })
+}
+
+// ShellAliasesFor returns the aliases that should
+// only be added to shell.
+func (c *Config) ShellAliasesFor(shell string) map[string]string {
+	return c.ShellAliases[shell]
+}
+
+// shellSyntax lists constructs that only work in
+// one of the supported shells.
+var shellSyntax = map[string][]string{
+	"bash": {"shopt ", "declare ", "$BASH", ",,}", "^^}"},
+	"zsh":  {"setopt ", "autoload ", "print -P", "${(", "=("},
+}
+
+// SetShell changes the configured shell and saves the
+// configuration. It returns the aliases that use syntax
+// specific to another shell, which are logged as warnings
+// and will need to be fixed by hand.
+func (c *Config) SetShell(shell string) ([]string, error) {
+	if c.Locked {
+		return nil, ErrConfigLocked
+	}
+	if !isValueInList(shell, shells) {
+		return nil, ErrInvalidShell
+	}
+	var problems []string
+	for name, value := range c.Aliases {
+		for other, syntax := range shellSyntax {
+			if other == shell {
+				continue
+			}
+			if lo.SomeBy(syntax, func(s string) bool { return strings.Contains(value, s) }) {
+				fin.Logger.Warn("alias may not work in "+shell, fin.Logger.Args("alias", name, "value", value))
+				problems = append(problems, name)
+				break
+			}
+		}
+	}
+	sort.Strings(problems)
+	old := c.Shell
+	c.Shell = shell
+	err := c.Validate()
+	if err != nil {
+		c.Shell = old
+		return problems, err
+	}
+	return problems, c.Save()
+}
+
+// RenderAlias returns the alias called name formatted
+// using the syntax of the configured shell.
+func (c *Config) RenderAlias(name string) (string, error) {
+	value, ok := c.Aliases[name]
+	if !ok {
+		value, ok = systemAliases[name]
+	}
+	if !ok {
+		return "", ErrAliasNotFound
+	}
+	// bash and zsh share the alias syntax
+	return "alias " + name + "='" + strings.ReplaceAll(value, "'", `'\''`) + "'", nil
+}
+
 func (c *Config) AddPackage(pack string) error {
+	if c.Locked {
+		return ErrConfigLocked
+	}
 	var found bool
 	for _, p := range c.Packages {
 		if p == pack {
@@ -389,6 +961,9 @@ func (c *Config) AddPackage(pack string) error {
 	return c.Save()
 }
 func (c *Config) RemovePackage(pack string) error {
+	if c.Locked {
+		return ErrConfigLocked
+	}
 	var index int
 	var found bool
 	for x, p := range c.Packages {
@@ -398,18 +973,44 @@ func (c *Config) RemovePackage(pack string) error {
 			break
 		}
 	}
-	if found {
-		c.Packages = append(c.Packages[:index], c.Packages[index+1:]...)
-	} else {
+	if !found {
 		return ErrPackageNotFound
 	}
+	// removing it locally wouldn't remove it from the base
+	if c.base != nil && isValueInList(pack, c.base.Packages) {
+		return fmt.Errorf("%w: %s", ErrSetByBase, pack)
+	}
+	c.Packages = append(c.Packages[:index], c.Packages[index+1:]...)
 	err := c.Validate()
 	if err != nil {
 		return err
 	}
 	return c.Save()
 }
+
+// FindPackages returns the configured packages whose names
+// contain substr, ignoring case. If withBling is true the
+// packages supplied by the bling level are searched too.
+func (c *Config) FindPackages(substr string, withBling bool) []string {
+	packages := c.Packages
+	if withBling {
+		// on error the user packages are still returned
+		packages, _ = c.EffectivePackages()
+	}
+	needle := strings.ToLower(substr)
+	matches := []string{}
+	for _, p := range packages {
+		if strings.Contains(strings.ToLower(p), needle) {
+			matches = append(matches, p)
+		}
+	}
+	return matches
+}
+
 func (c *Config) RemoveProgram(prog string) error {
+	if c.Locked {
+		return ErrConfigLocked
+	}
 	var index int
 	var found bool
 	for x, p := range c.Programs {
@@ -419,11 +1020,14 @@ func (c *Config) RemoveProgram(prog string) error {
 			break
 		}
 	}
-	if found {
-		c.Programs = append(c.Programs[:index], c.Programs[index+1:]...)
-	} else {
+	if !found {
 		return ErrProgramNotFound
 	}
+	// removing it locally wouldn't remove it from the base
+	if c.base != nil && isValueInList(prog, c.base.Programs) {
+		return fmt.Errorf("%w: %s", ErrSetByBase, prog)
+	}
+	c.Programs = append(c.Programs[:index], c.Programs[index+1:]...)
 	err := c.Validate()
 	if err != nil {
 		return err
@@ -431,6 +1035,9 @@ func (c *Config) RemoveProgram(prog string) error {
 	return c.Save()
 }
 func (c *Config) AddProgram(prog string) error {
+	if c.Locked {
+		return ErrConfigLocked
+	}
 	c.Programs = append(c.Programs, prog)
 	err := c.Validate()
 	if err != nil {
@@ -439,28 +1046,107 @@ func (c *Config) AddProgram(prog string) error {
 	return c.Save()
 }
 
-func (c *Config) Save() error {
-	cfile, err := c.Location()
+// AddPackages adds every package that isn't already
+// configured, then validates and saves once. If any name
+// is invalid nothing is added and the returned error
+// lists each invalid name.
+func (c *Config) AddPackages(packs ...string) error {
+	return c.addAll(&c.Packages, ErrInvalidPackageName, packs)
+}
+
+// AddPrograms is like AddPackages for programs.
+func (c *Config) AddPrograms(progs ...string) error {
+	return c.addAll(&c.Programs, ErrInvalidProgramName, progs)
+}
+
+// validName reports whether name can be used as
+// a package or program name.
+func validName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t\n")
+}
+
+func (c *Config) addAll(list *[]string, invalid error, names []string) error {
+	if c.Locked {
+		return ErrConfigLocked
+	}
+	var errs []error
+	for _, name := range names {
+		if !validName(name) {
+			errs = append(errs, fmt.Errorf("%w: %q", invalid, name))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	var added bool
+	for _, name := range names {
+		if !isValueInList(name, *list) {
+			*list = append(*list, name)
+			added = true
+		}
+	}
+	if !added {
+		return nil
+	}
+	err := c.Validate()
 	if err != nil {
 		return err
 	}
-	cfg, err := os.Create(cfile)
+	return c.Save()
+}
+
+// EnsurePackage adds pack to the configured packages and,
+// if withProgram isn't empty, adds withProgram to the
+// configured programs. Entries that are already present are
+// left alone. The configuration is validated and saved once.
+func (c *Config) EnsurePackage(pack string, withProgram string) error {
+	if c.Locked {
+		return ErrConfigLocked
+	}
+	var changed bool
+	if !isValueInList(pack, c.Packages) {
+		c.Packages = append(c.Packages, pack)
+		changed = true
+	}
+	if withProgram != "" && !isValueInList(withProgram, c.Programs) {
+		c.Programs = append(c.Programs, withProgram)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	err := c.Validate()
+	if err != nil {
+		return err
+	}
+	return c.Save()
+}
+
+func (c *Config) Save() error {
+	if c.Locked {
+		return ErrConfigLocked
+	}
+	if c.encrypted || len(c.recipients) > 0 {
+		return c.SaveEncrypted(c.recipients)
+	}
+	cfile, err := c.Location()
 	if err != nil {
 		return err
 	}
-	bb, err := yaml.Marshal(&c)
+	c.warnAnchors(cfile)
+	n, err := c.marshal()
 	if err != nil {
 		return err
 	}
-	m := make(map[interface{}]interface{})
-	err = yaml.Unmarshal(bb, &m)
+	err = os.MkdirAll(filepath.Dir(cfile), 0755)
 	if err != nil {
 		return err
 	}
-	n, err := yaml.Marshal(&m)
+	cfg, err := os.Create(cfile)
 	if err != nil {
 		return err
 	}
+	defer cfg.Close()
 	// convert to string to get `-` style lists
 	sbb := string(n)
 	_, err = cfg.WriteString(sbb)
@@ -470,48 +1156,342 @@ func (c *Config) Save() error {
 	return nil
 }
 
-// ReadConfig returns the configuration data
-// pointed to in the $HOME/.fleek.yml symlink
-func ReadConfig(loc string) (*Config, error) {
-	c := &Config{}
-	home, err := os.UserHomeDir()
+// marshal returns the local layer of the configuration
+// as it is written to the configuration file.
+func (c *Config) marshal() ([]byte, error) {
+	local, drop, err := c.localLayer()
 	if err != nil {
-		return c, err
+		return nil, err
+	}
+	bb, err := yaml.Marshal(&local)
+	if err != nil {
+		return nil, err
 	}
-	if loc == "" {
+	m := make(map[interface{}]interface{})
+	err = yaml.Unmarshal(bb, &m)
+	if err != nil {
+		return nil, err
+	}
+	prune(m, drop)
+	var root yaml.Node
+	err = root.Encode(&m)
+	if err != nil {
+		return nil, err
+	}
+	c.restoreSystemsComments(&root)
+	return yaml.Marshal(&root)
+}
 
-		csym := filepath.Join(home, ".fleek.yml")
-		loc = csym
-	} else {
+// Unlock clears the Locked flag and saves
+// the configuration.
+func (c *Config) Unlock() error {
+	c.Locked = false
+	return c.Save()
+}
+
+// configFileNames are the accepted names for the
+// configuration file, in the order they are probed.
+// The first entry is the canonical name used by Save.
+var configFileNames = []string{".fleek.yml", ".fleek.yaml", "fleek.yml"}
+
+// findConfigFile returns the path of the first accepted
+// configuration file name that exists in dir. If none
+// exist, the path and error for the canonical name are
+// returned.
+func findConfigFile(dir string) (string, error) {
+	for _, name := range configFileNames {
+		loc := filepath.Join(dir, name)
+		if Exists(loc) {
+			return loc, nil
+		}
+	}
+	loc := filepath.Join(dir, configFileNames[0])
+	_, err := os.Stat(loc)
+	return loc, err
+}
+
+// configPath returns the path of the configuration file
+// in loc, which is relative to $HOME. An empty loc means
+// the $HOME/.fleek.yml symlink.
+func configPath(loc string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := home
+	if loc != "" {
 		if strings.HasPrefix(loc, home) {
-			loc = filepath.Join(loc, ".fleek.yml")
+			dir = loc
 		} else {
-			loc = filepath.Join(home, loc, ".fleek.yml")
+			dir = filepath.Join(home, loc)
 		}
 	}
+	return findConfigFile(dir)
+}
+
+// overridePath returns the configuration file named by
+// the FLEEK_CONFIG override, which may be a file or a
+// directory containing one.
+func overridePath(override string) (string, error) {
+	if IsDir(override) {
+		return findConfigFile(override)
+	}
+	_, err := os.Stat(override)
+	return override, err
+}
+
+// resolveConfigPath returns the configuration file
+// named by the FLEEK_CONFIG override if it's set, or
+// the one in loc.
+func resolveConfigPath(loc string) (string, error) {
+	if override, _ := ConfigOverride(); override != "" {
+		return overridePath(override)
+	}
+	return configPath(loc)
+}
+
+// ConfigMeta holds the scalar settings of a
+// configuration file, see ReadConfigMeta.
+type ConfigMeta struct {
+	FlakeDir string `yaml:"flakedir"`
+	Shell    string `yaml:"shell"`
+	Bling    string `yaml:"bling"`
+	Ejected  bool   `yaml:"ejected"`
+}
+
+// ReadConfigMeta decodes only the settings in ConfigMeta
+// from the configuration file ReadConfig would read,
+// for callers like status prompts that don't need the
+// package lists. The result isn't validated and a Base
+// configuration isn't resolved.
+func ReadConfigMeta() (ConfigMeta, error) {
+	var meta ConfigMeta
+	loc, err := resolveConfigPath("")
+	if err != nil {
+		return meta, err
+	}
 	bb, err := os.ReadFile(loc)
+	if err != nil {
+		return meta, err
+	}
+	if isEncrypted(bb) {
+		return meta, ErrConfigEncrypted
+	}
+	err = yaml.Unmarshal(bb, &meta)
+	if err != nil {
+		return meta, parseError(loc, err)
+	}
+	return meta, nil
+}
+
+// ReadConfig returns the configuration data
+// pointed to in the $HOME/.fleek.yml symlink,
+// or the FLEEK_CONFIG environment variable if set
+func ReadConfig(loc string) (*Config, error) {
+	return readConfig(loc, false)
+}
+
+// ReadConfigStrict is like ReadConfig, but returns an
+// error naming any key in the configuration file that
+// doesn't match a configuration field.
+func ReadConfigStrict(loc string) (*Config, error) {
+	return readConfig(loc, true)
+}
+
+// ReadConfigReader reads a configuration from r and
+// validates it. Parse errors are reported against the
+// name "-". There is no symlink, $HOME or Base handling.
+func ReadConfigReader(r io.Reader) (*Config, error) {
+	bb, err := io.ReadAll(r)
+	if err != nil {
+		return &Config{}, err
+	}
+	if isEncrypted(bb) {
+		return &Config{}, ErrConfigEncrypted
+	}
+	c, err := parseConfig("-", bb, false)
 	if err != nil {
 		return c, err
 	}
-	err = yaml.Unmarshal(bb, c)
+	c.location = ""
+	return c, c.Validate()
+}
+
+// ValidateFile reads the configuration file at path and
+// validates it, returning every problem found. Unlike
+// ReadConfig it doesn't follow the $HOME/.fleek.yml symlink
+// or resolve a Base configuration, and writes nothing.
+// Relative file paths are resolved against the directory
+// holding path, not the configured flakedir.
+func ValidateFile(path string) error {
+	c, err := readConfigFile(path, false)
+	if err != nil {
+		return err
+	}
+	return errors.Join(c.validationErrorsIn(filepath.Dir(path))...)
+}
+
+func readConfig(loc string, strict bool) (*Config, error) {
+	return readConfigWith(loc, func(path string) (*Config, error) {
+		return readConfigFile(path, strict)
+	})
+}
+
+// readConfigWith finds the configuration file for loc, reads
+// it with read, and resolves its Base configuration.
+func readConfigWith(loc string, read func(string) (*Config, error)) (*Config, error) {
+	c := &Config{}
+	override, _ := ConfigOverride()
+	loc, err := resolveConfigPath(loc)
 	if err != nil {
 		return c, err
 	}
+	c, err = read(loc)
+	if err != nil {
+		return c, err
+	}
+	// a mismatched flakedir is only a warning,
+	// see FlakeDirMismatch
+	var mismatch error
+	if override == "" {
+		mismatch = c.checkFlakeDir(loc)
+	}
+	if mismatch != nil && !errors.Is(mismatch, ErrFlakeDirMismatch) {
+		return c, mismatch
+	}
+	if c.Base != "" {
+		resolved, err := c.ResolveConfig()
+		if err != nil {
+			return c, err
+		}
+		c = resolved
+	}
+	c.mismatch = mismatch
 	return c, nil
 }
 
+// FlakeDirMismatch returns an ErrFlakeDirMismatch if the
+// configuration file wasn't read from inside its flakedir,
+// usually because the flake directory was moved. It's a
+// warning, the configuration is still usable.
+func (c *Config) FlakeDirMismatch() error {
+	return c.mismatch
+}
+
+// readConfigFile parses the configuration file at loc.
+// If strict is true unknown keys are an error.
+func readConfigFile(loc string, strict bool) (*Config, error) {
+	bb, err := os.ReadFile(loc)
+	if err != nil {
+		return &Config{location: loc}, err
+	}
+	if isEncrypted(bb) {
+		return &Config{location: loc}, ErrConfigEncrypted
+	}
+	return parseConfig(loc, bb, strict)
+}
+
+// parseConfig decodes the configuration file contents
+// bb that were read from loc.
+func parseConfig(loc string, bb []byte, strict bool) (*Config, error) {
+	c := &Config{location: loc}
+	dec := yaml.NewDecoder(bytes.NewReader(bb))
+	dec.KnownFields(strict)
+	err := dec.Decode(c)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return c, parseError(loc, err)
+	}
+	c.systemsKey, c.systemsValue = systemsComments(bb)
+	c.anchors = usesAnchors(bb)
+	c.keys = fileKeys(bb)
+	return c, nil
+}
+
+var yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// ParseError is returned when the configuration
+// file can't be parsed. Each message is prefixed with
+// the file path and, when known, the line number.
+type ParseError struct {
+	Path     string
+	Messages []string
+	Err      error
+}
+
+func (e *ParseError) Error() string {
+	return strings.Join(e.Messages, "\n")
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// parseError converts a yaml.v3 error into a ParseError
+// with messages in the form `path:line: message`.
+func parseError(loc string, err error) error {
+	var lines []string
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		lines = typeErr.Errors
+	} else {
+		lines = []string{err.Error()}
+	}
+	pe := &ParseError{Path: loc, Err: err}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		m := yamlLine.FindStringSubmatch(line)
+		if m != nil {
+			pe.Messages = append(pe.Messages, loc+":"+m[1]+": "+m[2])
+		} else {
+			pe.Messages = append(pe.Messages, loc+": "+strings.TrimPrefix(line, "yaml: "))
+		}
+	}
+	return pe
+}
+
+// checkFlakeDir verifies that the configuration file
+// at loc, after resolving any symlinks, lives in the
+// flake directory named by the configuration.
+func (c *Config) checkFlakeDir(loc string) error {
+	if c.FlakeDir == "" {
+		return nil
+	}
+	target, err := filepath.EvalSymlinks(loc)
+	if err != nil {
+		return err
+	}
+	configDir := filepath.Dir(target)
+	flakeDir, err := filepath.EvalSymlinks(c.configFlakeDir())
+	if err != nil {
+		flakeDir = c.configFlakeDir()
+	}
+	if configDir != flakeDir {
+		return fmt.Errorf("%w: %s is in %s, flakedir is %s", ErrFlakeDirMismatch, loc, configDir, flakeDir)
+	}
+	return nil
+}
+
 func (c *Config) WriteInitialConfig(force bool, symlink bool) error {
+	return c.WriteInitialConfigFor(nil, force, symlink)
+}
+
+// WriteInitialConfigFor is like WriteInitialConfig but the
+// local system is registered with user instead of prompting
+// for one with NewUser, unless user is nil.
+func (c *Config) WriteInitialConfigFor(user *User, force bool, symlink bool) error {
 	systemAliases["fleeks"] = "cd ~/" + c.FlakeDir
 	sys, err := NewSystem()
 	if err != nil {
 		fin.Logger.Debug("new system", fin.Logger.Args("error", err))
 		return err
 	}
-	user, err := NewUser()
-	if err != nil {
-		fin.Logger.Debug("new user", fin.Logger.Args("error", err))
+	if user == nil {
+		user, err = NewUser()
+		if err != nil {
+			fin.Logger.Debug("new user", fin.Logger.Args("error", err))
 
-		return err
+			return err
+		}
 	}
 	sys.User = user
 	c.Unfree = true
@@ -578,11 +1558,9 @@ func (c *Config) WriteInitialConfig(force bool, symlink bool) error {
 		if err != nil {
 			return err
 		}
-		if symlink {
-			// ignore the error. Delete if it exists
-			_ = os.Remove(filepath.Join(home, ".fleek.yml"))
+		if _, override := ConfigOverride(); symlink && !override {
 			csym := filepath.Join(home, ".fleek.yml")
-			err = os.Symlink(cfile, csym)
+			err = ForceSymlink(cfile, csym)
 			if err != nil {
 				return err
 			}
@@ -594,37 +1572,67 @@ func (c *Config) WriteInitialConfig(force bool, symlink bool) error {
 	return nil
 }
 
-// WriteEjectConfig updates the .fleek.yml file
-// to indicated ejected status
-func (c *Config) Eject() error {
+// Eject updates the .fleek.yml file to indicate ejected
+// status. The generated flake files are first copied to
+// pre-eject-backup in the flake directory, so later hand
+// edits can be compared or reverted. It returns the
+// backup directory.
+func (c *Config) Eject() (backup string, err error) {
+	if c.Locked {
+		return "", ErrConfigLocked
+	}
+	backup, err = c.backupGeneratedFiles()
+	if err != nil {
+		return "", err
+	}
 
 	c.Ejected = true
+	return backup, c.Save()
+}
 
-	cfile, err := c.Location()
-	if err != nil {
-		return err
+// GeneratedFiles returns the files in the flake directory,
+// relative to it, that fleek overwrites on every write.
+// user.nix and the per-host custom.nix are meant to be
+// edited by hand and aren't included.
+func (c *Config) GeneratedFiles() []string {
+	files := []string{"flake.nix", "README.md", "home.nix", "aliases.nix", "path.nix", "programs.nix", "shell.nix"}
+	for _, sys := range c.Systems {
+		if sys.User != nil {
+			files = append(files, filepath.Join(sys.Hostname, sys.User.Username+".nix"))
+		}
 	}
+	return files
+}
 
-	bb, err := yaml.Marshal(&c)
+// backupGeneratedFiles copies the generated files that
+// exist into the pre-eject-backup directory of the flake
+// directory, replacing an earlier backup, and returns
+// the backup directory.
+func (c *Config) backupGeneratedFiles() (string, error) {
+	backup := filepath.Join(c.UserFlakeDir(), "pre-eject-backup")
+	err := os.RemoveAll(backup)
 	if err != nil {
-		return err
+		return "", err
 	}
-	m := make(map[interface{}]interface{})
-	err = yaml.Unmarshal(bb, &m)
-	if err != nil {
-		return err
-	}
-	n, err := yaml.Marshal(&m)
-	if err != nil {
-		return err
-	}
-
-	err = os.WriteFile(cfile, n, 0755)
-	if err != nil {
-		return err
+	for _, name := range c.GeneratedFiles() {
+		bb, err := os.ReadFile(filepath.Join(c.UserFlakeDir(), name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		dst := filepath.Join(backup, name)
+		err = os.MkdirAll(filepath.Dir(dst), 0755)
+		if err != nil {
+			return "", err
+		}
+		err = os.WriteFile(dst, bb, 0644)
+		if err != nil {
+			return "", err
+		}
 	}
-
-	return nil
+	return backup, nil
 }
 
 func (c *Config) AsVersion() (*version.Version, error) {
@@ -704,10 +1712,13 @@ func (c *Config) Migrate() error {
 		}
 		if s.User == nil {
 			fin.Logger.Warn("Migrating users", fin.Logger.Args("hostname", s.Hostname))
-			sysuser := c.UserForSystem(s.Hostname)
+			sysuser, err := c.UserForSystem(s.Hostname)
+			if err != nil {
+				return err
+			}
 
 			s.User = sysuser
-			err := c.Save()
+			err = c.Save()
 			if err != nil {
 				return err
 			}
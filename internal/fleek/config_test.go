@@ -1,10 +1,18 @@
 package fleek
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/ublue-os/fleek/internal/envir"
 	"github.com/ublue-os/fleek/internal/xdg"
 )
 
@@ -106,3 +114,881 @@ func TestUserFlakeDir(t *testing.T) {
 	}
 
 }
+
+func TestFindConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	_, err := findConfigFile(dir)
+	if err == nil {
+		t.Fatalf("find config file: expected error for empty dir")
+	}
+	alt := filepath.Join(dir, "fleek.yml")
+	err = os.WriteFile(alt, []byte("shell: bash\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := findConfigFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != alt {
+		t.Fatalf("find config file: expected %s, got %s", alt, got)
+	}
+	canonical := filepath.Join(dir, ".fleek.yml")
+	err = os.WriteFile(canonical, []byte("shell: bash\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = findConfigFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != canonical {
+		t.Fatalf("find config file: expected %s, got %s", canonical, got)
+	}
+}
+
+func TestLockedConfig(t *testing.T) {
+	c := &Config{
+		FlakeDir: t.TempDir(),
+		Shell:    "bash",
+		Bling:    "default",
+		Locked:   true,
+	}
+	if err := c.AddPackage("jq"); err != ErrConfigLocked {
+		t.Fatalf("locked add package: expected %v, got %v", ErrConfigLocked, err)
+	}
+	if len(c.Packages) != 0 {
+		t.Fatalf("locked add package: config was modified")
+	}
+	if err := c.Save(); err != ErrConfigLocked {
+		t.Fatalf("locked save: expected %v, got %v", ErrConfigLocked, err)
+	}
+}
+
+func TestRenderAlias(t *testing.T) {
+	c := &Config{
+		Shell: "bash",
+		Aliases: map[string]string{
+			"hi": "echo 'hi there'",
+		},
+	}
+	got, err := c.RenderAlias("hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `alias hi='echo '\''hi there'\'''`
+	if got != want {
+		t.Fatalf("render alias: expected %s, got %s", want, got)
+	}
+	_, err = c.RenderAlias("missing")
+	if err != ErrAliasNotFound {
+		t.Fatalf("render alias: expected %v, got %v", ErrAliasNotFound, err)
+	}
+}
+
+func TestReadConfigParseError(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	loc := filepath.Join(home, ".fleek.yml")
+	err := os.WriteFile(loc, []byte("shell: bash\npackages:\n  - git\n bling: [\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadConfig("")
+	if err == nil {
+		t.Fatal("read config: expected parse error")
+	}
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("read config: expected *ParseError, got %T", err)
+	}
+	want := loc + ":3: did not find expected key"
+	if err.Error() != want {
+		t.Fatalf("read config: expected %q, got %q", want, err.Error())
+	}
+
+	err = os.WriteFile(loc, []byte("shell: [bash]\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadConfig("")
+	want = loc + ":1: cannot unmarshal !!seq into string"
+	if err == nil || err.Error() != want {
+		t.Fatalf("read config: expected %q, got %v", want, err)
+	}
+}
+
+func TestResolveConfig(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	flakeDir := filepath.Join(home, "flake")
+	err := os.MkdirAll(flakeDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "shell: zsh\nbling: high\nunfree: true\ngit:\n  autopush: true\npackages:\n  - git\n  - jq\naliases:\n  ll: ls -l\n"
+	err = os.WriteFile(filepath.Join(home, "base.yml"), []byte(base), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := "flakedir: flake\nbase: ../base.yml\nshell: bash\nunfree: false\ngit:\n  autopush: false\npackages:\n  - jq\n  - helix\n"
+	err = os.WriteFile(filepath.Join(flakeDir, ".fleek.yml"), []byte(local), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadConfig("flake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Shell != "bash" || c.Bling != "high" {
+		t.Fatalf("resolve config: expected bash/high, got %s/%s", c.Shell, c.Bling)
+	}
+	if c.Unfree || c.Git.AutoPush {
+		t.Fatalf("resolve config: local false values should win over the base")
+	}
+	want := []string{"git", "jq", "helix"}
+	if strings.Join(c.Packages, ",") != strings.Join(want, ",") {
+		t.Fatalf("resolve config: expected packages %v, got %v", want, c.Packages)
+	}
+	if c.Aliases["ll"] != "ls -l" {
+		t.Fatalf("resolve config: expected base alias")
+	}
+	err = c.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := readConfigFile(filepath.Join(flakeDir, ".fleek.yml"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// jq is listed locally too, so it stays in the local file
+	if strings.Join(saved.Packages, ",") != "jq,helix" || saved.Bling != "" {
+		t.Fatalf("resolve config: expected only the local values saved, got %v %s", saved.Packages, saved.Bling)
+	}
+	if _, ok := saved.keys["unfree"]; !ok || saved.keys["git"]["autopush"] == nil {
+		t.Fatalf("resolve config: local false values were dropped on save")
+	}
+	if _, ok := saved.keys["bling"]; ok {
+		t.Fatalf("resolve config: base bling was saved locally")
+	}
+
+	err = c.RemovePackage("git")
+	if !errors.Is(err, ErrSetByBase) || !isValueInList("git", c.Packages) {
+		t.Fatalf("remove package: expected %v for a base package, got %v", ErrSetByBase, err)
+	}
+
+	err = os.WriteFile(filepath.Join(home, "base.yml"), []byte("base: flake/.fleek.yml\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadConfig("flake")
+	if !errors.Is(err, ErrCircularBase) {
+		t.Fatalf("resolve config: expected %v, got %v", ErrCircularBase, err)
+	}
+}
+
+func TestReadConfigStrict(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	err := os.WriteFile(filepath.Join(home, ".fleek.yml"), []byte("shell: bash\npackges:\n  - git\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadConfig("")
+	if err != nil {
+		t.Fatalf("read config: expected unknown keys to be ignored, got %v", err)
+	}
+	_, err = ReadConfigStrict("")
+	if err == nil || !strings.Contains(err.Error(), "packges") {
+		t.Fatalf("read config strict: expected error naming `packges`, got %v", err)
+	}
+}
+
+func TestConfigOverride(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	override := filepath.Join(t.TempDir(), "fleek.yml")
+	err := os.WriteFile(override, []byte("shell: fish\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envir.ConfigPath, override)
+	c, err := ReadConfig("")
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	if c.Shell != "fish" {
+		t.Fatalf("read config: expected shell fish, got %s", c.Shell)
+	}
+	loc, err := c.Location()
+	if err != nil || loc != override {
+		t.Fatalf("location: expected %s, got %s (%v)", override, loc, err)
+	}
+}
+
+func TestSaveKeepsSystemComments(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	loc := filepath.Join(t.TempDir(), ".fleek.yml")
+	t.Setenv(envir.ConfigPath, loc)
+	yml := `shell: bash
+# machines
+systems:
+  # work laptop
+  - hostname: a # the thinkpad
+    username: u
+    arch: x86_64
+    os: linux
+`
+	err := os.WriteFile(loc, []byte(yml), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Packages = append(c.Packages, "jq")
+	err = c.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bb, err := os.ReadFile(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, comment := range []string{"# machines", "# work laptop", "# the thinkpad"} {
+		if !strings.Contains(string(bb), comment) {
+			t.Errorf("save: expected %q to be kept, got\n%s", comment, bb)
+		}
+	}
+}
+
+func TestValidateFile(t *testing.T) {
+	loc := filepath.Join(t.TempDir(), ".fleek.yml")
+	err := os.WriteFile(loc, []byte("flakedir: .local/share/fleek\nshell: tcsh\nbling: extreme\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ValidateFile(loc)
+	if !errors.Is(err, ErrInvalidShell) || !errors.Is(err, ErrInvalidBling) {
+		t.Fatalf("validate file: expected shell and bling errors, got %v", err)
+	}
+
+	// module paths are relative to the validated file
+	t.Setenv("HOME", t.TempDir())
+	err = os.WriteFile(filepath.Join(filepath.Dir(loc), "extra.nix"), []byte("{}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(loc, []byte("flakedir: .local/share/fleek\nshell: zsh\nbling: low\nmodules:\n  - extra.nix\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateFile(loc); err != nil {
+		t.Fatalf("validate file: expected module next to the file to be found, got %v", err)
+	}
+}
+
+func TestReadConfigReader(t *testing.T) {
+	c, err := ReadConfigReader(strings.NewReader("flakedir: .local/share/fleek\nshell: zsh\nbling: low\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Shell != "zsh" || c.Bling != "low" {
+		t.Fatalf("read config reader: unexpected result %+v", c)
+	}
+	_, err = ReadConfigReader(strings.NewReader("shell: [zsh\n"))
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("read config reader: expected a parse error, got %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	loc := filepath.Join(t.TempDir(), ".fleek.yml")
+	err := os.WriteFile(loc, []byte("shell: bash\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := readConfigFile(loc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interval, debounce := WatchInterval, WatchDebounce
+	WatchInterval, WatchDebounce = 10*time.Millisecond, 20*time.Millisecond
+	t.Cleanup(func() { WatchInterval, WatchDebounce = interval, debounce })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shells := make(chan string, 1)
+	go func() {
+		_ = c.Watch(ctx, func(c *Config) error {
+			shells <- c.Shell
+			cancel()
+			return nil
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	err = os.WriteFile(loc, []byte("shell: zsh\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case shell := <-shells:
+		if shell != "zsh" {
+			t.Fatalf("watch: expected shell zsh, got %s", shell)
+		}
+	case <-ctx.Done():
+		t.Fatal("watch: change was not seen")
+	}
+}
+
+func TestIsValidFlakeRef(t *testing.T) {
+	cases := map[string]bool{
+		"github:ublue-os/fleek":          true,
+		"github:ublue-os":                false,
+		"git+https://example.com/r.git":  true,
+		"https://example.com/set.tar.gz": true,
+		"path:./sets":                    true,
+		"nixpkgs":                        false,
+		"ftp://example.com/set":          false,
+	}
+	for ref, want := range cases {
+		if got := IsValidFlakeRef(ref); got != want {
+			t.Errorf("flake ref %s: expected %v, got %v", ref, want, got)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	ours := &Config{
+		Shell:    "bash",
+		Packages: []string{"git"},
+		Aliases:  map[string]string{"ll": "ls -l"},
+	}
+	theirs := &Config{
+		Shell:    "zsh",
+		Bling:    "high",
+		Packages: []string{"git", "jq"},
+		Aliases:  map[string]string{"ll": "ls -la", "g": "git"},
+	}
+	err := ours.Merge(theirs, ConflictError)
+	if !errors.Is(err, ErrMergeConflict) {
+		t.Fatalf("merge: expected %v, got %v", ErrMergeConflict, err)
+	}
+	if ours.Bling != "" || len(ours.Packages) != 1 {
+		t.Fatalf("merge: config changed after conflict")
+	}
+	err = ours.Merge(theirs, OursWin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ours.Shell != "bash" || ours.Aliases["ll"] != "ls -l" || ours.Bling != "high" || len(ours.Packages) != 2 {
+		t.Fatalf("merge ours: unexpected result %+v", ours)
+	}
+	err = ours.Merge(theirs, TheirsWin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ours.Shell != "zsh" || ours.Aliases["ll"] != "ls -la" || ours.Aliases["g"] != "git" {
+		t.Fatalf("merge theirs: unexpected result %+v", ours)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	c := &Config{
+		FlakeDir: ".local/share/fleek",
+		Shell:    "zsh",
+		Bling:    "high",
+		Packages: []string{"git", "jq"},
+		Aliases:  map[string]string{"ll": "ls -l"},
+		Overlays: map[string]*Overlay{"emacs": {URL: "github:nix-community/emacs-overlay", Follow: true}},
+		Systems: []*System{
+			{Hostname: "a", Username: "u", Arch: "x86_64", OS: "linux", User: &User{Username: "u"}},
+		},
+		Git: Git{Enabled: true, AutoCommit: true},
+	}
+	if errs := c.roundTrip(); len(errs) > 0 {
+		t.Fatalf("round trip: unexpected errors %v", errs)
+	}
+}
+
+func TestNewConfig(t *testing.T) {
+	c, err := NewConfig(
+		WithShell("zsh"),
+		WithPackages("git", "jq", "git"),
+		WithSystem(&System{Hostname: "a", Username: "u", Arch: "aarch64", OS: "darwin"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Shell != "zsh" || c.Bling != "default" || len(c.Packages) != 2 || len(c.Systems) != 1 {
+		t.Fatalf("new config: unexpected result %+v", c)
+	}
+	_, err = NewConfig(WithBling("extreme"))
+	if err != ErrInvalidBling {
+		t.Fatalf("new config: expected %v, got %v", ErrInvalidBling, err)
+	}
+}
+
+func TestDetectShell(t *testing.T) {
+	for env, want := range map[string]string{
+		"/bin/zsh":            "zsh",
+		"/usr/local/bin/bash": "bash",
+		"/usr/bin/fish":       "bash",
+		"":                    "bash",
+	} {
+		t.Setenv("SHELL", env)
+		if got := DetectShell(); got != want {
+			t.Errorf("detect shell %q: expected %s, got %s", env, want, got)
+		}
+	}
+}
+
+func TestUsesAnchors(t *testing.T) {
+	anchored := []byte("systems:\n  - &base\n    hostname: a\n  - <<: *base\n    hostname: b\n")
+	if !usesAnchors(anchored) {
+		t.Fatal("anchors: expected anchors to be detected")
+	}
+	if usesAnchors([]byte("systems:\n  - hostname: a\n")) {
+		t.Fatal("anchors: unexpected anchors")
+	}
+}
+
+func TestForceSymlink(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "link")
+	for _, target := range []string{"a", "b", "b"} {
+		if err := ForceSymlink(filepath.Join(dir, target), link); err != nil {
+			t.Fatalf("force symlink: %v", err)
+		}
+	}
+	if got, _ := os.Readlink(link); got != filepath.Join(dir, "b") {
+		t.Fatalf("force symlink: link points to %s", got)
+	}
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ForceSymlink(link, file); !errors.Is(err, ErrNotSymlink) {
+		t.Fatalf("force symlink: expected %v, got %v", ErrNotSymlink, err)
+	}
+}
+
+func TestReadConfigMeta(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, ".fleek.yml"), []byte("flakedir: .config/home-manager\nshell: zsh\nbling: high\npackages:\n  - jq\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envir.ConfigPath, dir)
+	meta, err := ReadConfigMeta()
+	if err != nil {
+		t.Fatalf("read config meta: %v", err)
+	}
+	if meta.Shell != "zsh" || meta.Bling != "high" || meta.FlakeDir != ".config/home-manager" || meta.Ejected {
+		t.Fatalf("read config meta: unexpected result %+v", meta)
+	}
+}
+
+func TestFlakeDirMismatch(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	moved := filepath.Join(home, "moved")
+	err := os.MkdirAll(moved, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(moved, ".fleek.yml"), []byte("flakedir: flake\nshell: zsh\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadConfig("moved")
+	if err != nil {
+		t.Fatalf("flakedir mismatch: expected no error, got %v", err)
+	}
+	if !errors.Is(c.FlakeDirMismatch(), ErrFlakeDirMismatch) || c.Shell != "zsh" {
+		t.Fatalf("flakedir mismatch: expected %v, got %v", ErrFlakeDirMismatch, c.FlakeDirMismatch())
+	}
+}
+
+func TestExtraTiers(t *testing.T) {
+	c := &Config{
+		FlakeDir:   ".config/home-manager",
+		Shell:      "bash",
+		Bling:      "max",
+		ExtraTiers: map[string][]string{"max": {"htop", "ripgrep"}},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("extra tiers: %v", err)
+	}
+	b, err := c.CurrentBling()
+	if err != nil {
+		t.Fatal(err)
+	}
+	high, _ := HighBling()
+	if !isValueInList("htop", b.Packages) || len(b.Packages) < len(high.Packages) {
+		t.Fatalf("extra tiers: expected high packages plus extras, got %v", b.Packages)
+	}
+	c.Bling = "ultra"
+	if err := c.Validate(); err != ErrInvalidBling {
+		t.Fatalf("extra tiers: expected %v, got %v", ErrInvalidBling, err)
+	}
+}
+
+func TestSystemHostname(t *testing.T) {
+	c := &Config{Systems: []*System{{Hostname: "laptop"}, {Hostname: "server.example.com"}}}
+	for host, want := range map[string]string{"laptop": "laptop", "laptop.lan": "laptop", "server": "server.example.com", "SERVER.example.com": "server.example.com"} {
+		sys, err := c.System(host)
+		if err != nil || sys.Hostname != want {
+			t.Fatalf("system %s: expected %s, got %v (%v)", host, want, sys, err)
+		}
+	}
+	if _, err := c.System("desktop"); !errors.Is(err, ErrSysNotFound) {
+		t.Fatalf("system: expected %v, got %v", ErrSysNotFound, err)
+	}
+	if sys, err := c.GetSystem("laptop.lan"); err != nil || sys.Hostname != "laptop" {
+		t.Fatalf("get system: expected laptop, got %v (%v)", sys.Hostname, err)
+	}
+}
+
+func TestMergeRemote(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("packages:\n  - jq\n  - ripgrep\nprograms:\n  - bat\n"))
+	}))
+	defer srv.Close()
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(envir.ConfigPath, filepath.Join(t.TempDir(), ".fleek.yml"))
+	c := &Config{FlakeDir: ".config/home-manager", Shell: "bash", Bling: "default", Packages: []string{"git"}}
+	err := c.MergeRemote(srv.URL+"/fleek.yml", []string{"jq", "bat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(c.Packages, ",") != "git,jq" || strings.Join(c.Programs, ",") != "bat" {
+		t.Fatalf("merge remote: unexpected result %v %v", c.Packages, c.Programs)
+	}
+	err = c.MergeRemote(srv.URL+"/fleek.yml", []string{"helix"})
+	if !errors.Is(err, ErrPackageNotFound) {
+		t.Fatalf("merge remote: expected %v, got %v", ErrPackageNotFound, err)
+	}
+}
+
+func TestConfigJSONSchema(t *testing.T) {
+	var schema struct {
+		Properties map[string]struct {
+			Type    string   `json:"type"`
+			Enum    []string `json:"enum"`
+			Pattern string   `json:"pattern"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(ConfigJSONSchema(), &schema); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	if p := schema.Properties["packages"]; p.Type != "array" {
+		t.Fatalf("schema: expected packages to be an array, got %q", p.Type)
+	}
+	if p := schema.Properties["shell"]; strings.Join(p.Enum, ",") != strings.Join(shells, ",") {
+		t.Fatalf("schema: expected shell enum %v, got %v", shells, p.Enum)
+	}
+	if _, ok := schema.Properties["systems"]; !ok {
+		t.Fatal("schema: missing systems")
+	}
+	if p := schema.Properties["state_version"]; p.Pattern != stateVersion.String() {
+		t.Fatalf("schema: expected state_version pattern, got %q", p.Pattern)
+	}
+}
+
+func TestStateVersion(t *testing.T) {
+	for version, valid := range map[string]bool{"18.09": true, "21.03": true, "24.05": true, "24.11": true, "25.11": true, "24.06": false, "20.05": false, "24": false} {
+		c := &Config{FlakeDir: ".config/home-manager", Shell: "bash", Bling: "default", StateVersion: version}
+		if err := c.Validate(); (err == nil) != valid {
+			t.Errorf("state version %s: expected valid %v, got %v", version, valid, err)
+		}
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	err := os.WriteFile(filepath.Join(home, "base.yml"), []byte("bling: high\npackages:\n  - git\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := filepath.Join(home, "local.yml")
+	err = os.WriteFile(local, []byte("base: base.yml\nshell: zsh\npackages:\n  - jq\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := readConfigFile(local, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flat, err := c.Flatten()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flat.Base != "" || flat.Bling != "high" || strings.Join(flat.Packages, ",") != "git,jq" {
+		t.Fatalf("flatten: unexpected result %+v", flat)
+	}
+	if c.Base != "base.yml" || len(c.Packages) != 1 {
+		t.Fatalf("flatten: configuration was modified")
+	}
+}
+
+// fakeAge puts an age script on PATH that "encrypts" by
+// prefixing the age armor header and records the
+// recipients of the last encryption in the returned file.
+func fakeAge(t *testing.T) string {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "recipients.log")
+	script := "#!/bin/sh\ncase \"$1\" in\n--encrypt) shift 2; echo \"$@\" > " + log + "; echo '" + ageArmor + "'; cat ;;\n--decrypt) sed 1d ;;\nesac\n"
+	err := os.WriteFile(filepath.Join(dir, "age"), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return log
+}
+
+func TestSaveEncrypted(t *testing.T) {
+	log := fakeAge(t)
+	t.Setenv("HOME", t.TempDir())
+	loc := filepath.Join(t.TempDir(), ".fleek.yml")
+	t.Setenv(envir.ConfigPath, loc)
+	c := &Config{FlakeDir: ".config/home-manager", Shell: "bash", Bling: "default", Packages: []string{"git"}}
+	err := c.SaveEncrypted([]string{"age1alice", "age1bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bb, err := os.ReadFile(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncrypted(bb) {
+		t.Fatalf("save encrypted: file isn't encrypted:\n%s", bb)
+	}
+	recipients, err := readRecipients(loc)
+	if err != nil || strings.Join(recipients, ",") != "age1alice,age1bob" {
+		t.Fatalf("save encrypted: expected both recipients, got %v (%v)", recipients, err)
+	}
+
+	read, err := ReadConfigEncrypted("identity.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(read.recipients, ",") != "age1alice,age1bob" || read.Packages[0] != "git" {
+		t.Fatalf("read encrypted: unexpected result %+v", read)
+	}
+	err = read.Merge(&Config{Packages: []string{"jq"}}, TheirsWin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = read.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bb, err = os.ReadFile(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncrypted(bb) || !strings.Contains(string(bb), "jq") {
+		t.Fatalf("save after merge: expected the merged file to stay encrypted:\n%s", bb)
+	}
+	logged, err := os.ReadFile(log)
+	if err != nil || !strings.Contains(string(logged), "age1alice") || !strings.Contains(string(logged), "age1bob") {
+		t.Fatalf("save after merge: expected both recipients, got %q (%v)", logged, err)
+	}
+}
+
+func TestDeadAliasBuiltins(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	c := &Config{}
+	for shell, commands := range map[string][]string{
+		"bash": {"shopt -s globstar", "complete -F _git g", "hash -r", "readonly X"},
+		"zsh":  {"bindkey -e", "autoload -U compinit", "print -P %n", "zstyle ':completion:*' menu select", "unsetopt beep"},
+	} {
+		for _, command := range commands {
+			if c.deadAlias(command, nil) {
+				t.Errorf("dead alias: %s builtin pruned: %s", shell, command)
+			}
+		}
+	}
+	if !c.deadAlias("notacommand --flag", nil) {
+		t.Error("dead alias: expected a missing command to be pruned")
+	}
+}
+
+func TestFlakesEnabled(t *testing.T) {
+	dir := t.TempDir()
+	nix := filepath.Join(dir, "nix")
+	err := os.WriteFile(nix, []byte("#!/bin/sh\necho 'experimental-features = nix-command'\necho 'extra-experimental-features = flakes'\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envir.NixBin, nix)
+	if !flakesEnabled() {
+		t.Fatal("flakes enabled: expected features from nix config show")
+	}
+	// without a working nix, NIX_CONFIG is read
+	t.Setenv(envir.NixBin, filepath.Join(dir, "missing"))
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("NIX_CONFIG", "extra-experimental-features = nix-command flakes")
+	if !flakesEnabled() {
+		t.Fatal("flakes enabled: expected features from NIX_CONFIG")
+	}
+}
+
+func TestUninstall(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(home, ".cache"))
+	dir := filepath.Join(home, "flake")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{FlakeDir: "flake"}
+
+	err = os.WriteFile(filepath.Join(dir, "flake.nix"), []byte("{ outputs = _: {}; }\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Uninstall(true)
+	if !errors.Is(err, ErrNotFleekFlake) || !IsDir(dir) {
+		t.Fatalf("uninstall: expected %v and the flake kept, got %v", ErrNotFleekFlake, err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "flake.nix"), []byte("# DO NOT EDIT: This file is managed by fleek.\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Ejected = true
+	_, err = c.Uninstall(true)
+	if !errors.Is(err, ErrEjectedFlake) || !IsDir(dir) {
+		t.Fatalf("uninstall: expected %v and the flake kept, got %v", ErrEjectedFlake, err)
+	}
+
+	c.Ejected = false
+	err = os.Symlink(filepath.Join(dir, ".fleek.yml"), filepath.Join(home, ".fleek.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := c.Uninstall(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Exists(dir) || !isValueInList(filepath.Join(home, ".fleek.yml"), removed) {
+		t.Fatalf("uninstall: expected the flake and symlink removed, got %v", removed)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	c := &Config{
+		FlakeDir:    "flake",
+		Systems:     []*System{{Hostname: "laptop"}},
+		Paths:       []string{"$HOME/bin", "/opt/tools/bin"},
+		Workspaces:  map[string]string{"work": "work-flake"},
+		Workspace:   "work",
+		Modules:     []string{"modules/git.nix", "/home/me/private.nix", "github:me/modules"},
+		Secrets:     map[string]string{"token": "secrets/token.yaml", "key": "/home/me/key.yaml"},
+		Base:        "../base",
+		PackageSets: []string{"github:me/tools"},
+	}
+	s, err := c.Sanitize(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Systems != nil || s.Workspaces != nil || s.Workspace != "" || s.Base != "" {
+		t.Fatalf("sanitize: machine specific values kept: %+v", s)
+	}
+	if strings.Join(s.Paths, ",") != "$HOME/bin" || strings.Join(s.Modules, ",") != "modules/git.nix,github:me/modules" || len(s.Secrets) != 1 {
+		t.Fatalf("sanitize: unexpected paths %v, modules %v or secrets %v", s.Paths, s.Modules, s.Secrets)
+	}
+	if len(s.PackageSets) != 1 {
+		t.Fatalf("sanitize: package sets removed without stripRemotes")
+	}
+	s, err = c.Sanitize(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(s.Modules, ",") != "modules/git.nix" || s.PackageSets != nil {
+		t.Fatalf("sanitize: remotes kept: modules %v, package sets %v", s.Modules, s.PackageSets)
+	}
+	if len(c.Systems) != 1 || c.Base != "../base" || len(c.Secrets) != 2 {
+		t.Fatal("sanitize: original configuration changed")
+	}
+}
+
+func TestIsSubmodule(t *testing.T) {
+	for gitdir, want := range map[string]bool{
+		"gitdir: ../.git/modules/flake\n":          true,
+		"gitdir: /home/me/dots/.git/modules/flake": true,
+		"gitdir: /home/me/flake/.git/worktrees/wt": false,
+		"not a git file":                           false,
+	} {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, ".git"), []byte(gitdir), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := IsSubmodule(dir); got != want {
+			t.Errorf("IsSubmodule(%q) = %v, want %v", gitdir, got, want)
+		}
+	}
+	if IsSubmodule(t.TempDir()) {
+		t.Error("IsSubmodule: true without a .git file")
+	}
+}
+
+func TestSetShellInvalid(t *testing.T) {
+	c := &Config{FlakeDir: "flake", Shell: "bash", Bling: "nope"}
+	if _, err := c.SetShell("zsh"); !errors.Is(err, ErrInvalidBling) {
+		t.Fatalf("SetShell: got %v, want %v", err, ErrInvalidBling)
+	}
+	if c.Shell != "bash" {
+		t.Fatalf("SetShell: shell changed to %q on error", c.Shell)
+	}
+}
+
+func TestPackageSourcesMatchOrigin(t *testing.T) {
+	c := &Config{
+		Bling:       "none",
+		Packages:    []string{"jq"},
+		PackageSets: []string{"github:me/tools"},
+		Systems: []*System{{
+			Hostname:        "laptop",
+			Specialisations: map[string][]string{"work": {"slack", "zoom"}, "gaming": {"steam", "zoom"}},
+		}},
+	}
+	origin := map[string]string{"user": "user", "package_sets": "package_set", "system:laptop": "system:laptop"}
+	sources := c.PackageSources()
+	if strings.Join(sources["system:laptop"], ",") != "slack,steam,zoom" {
+		t.Fatalf("PackageSources: system packages %v", sources["system:laptop"])
+	}
+	for source, packages := range sources {
+		for _, p := range packages {
+			got, err := c.PackageOrigin(p)
+			if err != nil {
+				t.Fatalf("PackageOrigin(%s): %v", p, err)
+			}
+			if !strings.Contains(got, origin[source]) {
+				t.Errorf("PackageOrigin(%s) = %q, PackageSources lists it under %s", p, got, source)
+			}
+		}
+	}
+}
+
+func TestUserForSystem(t *testing.T) {
+	me := &User{Username: "me"}
+	c := &Config{Systems: []*System{{Hostname: "laptop.example.com", Username: "me", User: me}}}
+	u, err := c.UserForSystem("laptop")
+	if err != nil || u != me {
+		t.Fatalf("UserForSystem(laptop) = %v, %v", u, err)
+	}
+	if _, err := c.UserForSystem("desktop"); !errors.Is(err, ErrSysNotFound) {
+		t.Fatalf("UserForSystem(desktop): got %v, want %v", err, ErrSysNotFound)
+	}
+}
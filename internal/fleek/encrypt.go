@@ -0,0 +1,138 @@
+package fleek
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ageArmor starts every age file encrypted with --armor.
+const ageArmor = "-----BEGIN AGE ENCRYPTED FILE-----"
+
+var (
+	ErrConfigEncrypted = errors.New("fleek.yml: configuration is encrypted, an age identity is required to read it")
+	ErrNoRecipients    = errors.New("at least one age recipient is required to encrypt the configuration")
+)
+
+func isEncrypted(bb []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(bb), []byte(ageArmor))
+}
+
+// SaveEncrypted writes the configuration file encrypted with
+// age to each of recipients, and the recipients to a
+// .recipients file next to it. Later calls to Save keep the
+// file encrypted to the same recipients. The age command
+// must be installed.
+func (c *Config) SaveEncrypted(recipients []string) error {
+	if c.Locked {
+		return ErrConfigLocked
+	}
+	if len(recipients) == 0 {
+		return ErrNoRecipients
+	}
+	cfile, err := c.Location()
+	if err != nil {
+		return err
+	}
+	c.warnAnchors(cfile)
+	n, err := c.marshal()
+	if err != nil {
+		return err
+	}
+	args := []string{"--encrypt", "--armor"}
+	for _, r := range recipients {
+		args = append(args, "--recipient", r)
+	}
+	encrypted, err := runAge(n, args...)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(cfile), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(cfile, encrypted, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(recipientsFile(cfile), []byte(strings.Join(recipients, "\n")+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	c.recipients = recipients
+	c.encrypted = true
+	return nil
+}
+
+// recipientsFile returns the path of the file listing
+// the recipients the configuration file cfile is
+// encrypted to, in the format of `age -R`.
+func recipientsFile(cfile string) string {
+	return cfile + ".recipients"
+}
+
+// readRecipients returns the recipients listed in
+// the recipients file for cfile.
+func readRecipients(cfile string) ([]string, error) {
+	bb, err := os.ReadFile(recipientsFile(cfile))
+	if err != nil {
+		return nil, err
+	}
+	var recipients []string
+	for _, line := range strings.Split(string(bb), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			recipients = append(recipients, line)
+		}
+	}
+	return recipients, nil
+}
+
+// ReadConfigEncrypted is like ReadConfig for a configuration
+// file saved with SaveEncrypted. identity is the path to an
+// age identity file able to decrypt it. The recipients Save
+// encrypts to again are read from the .recipients file, if
+// it's missing Save fails until SaveEncrypted is called.
+func ReadConfigEncrypted(identity string) (*Config, error) {
+	return readConfigWith("", func(loc string) (*Config, error) {
+		bb, err := os.ReadFile(loc)
+		if err != nil {
+			return &Config{location: loc}, err
+		}
+		if !isEncrypted(bb) {
+			return parseConfig(loc, bb, false)
+		}
+		plain, err := runAge(bb, "--decrypt", "--identity", identity)
+		if err != nil {
+			return &Config{location: loc}, err
+		}
+		c, err := parseConfig(loc, plain, false)
+		if err != nil {
+			return c, err
+		}
+		c.encrypted = true
+		c.recipients, err = readRecipients(loc)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return c, err
+		}
+		return c, nil
+	})
+}
+
+func runAge(input []byte, args ...string) ([]byte, error) {
+	command := exec.Command("age", args...)
+	command.Env = os.Environ()
+	command.Stdin = bytes.NewReader(input)
+	var errBuf bytes.Buffer
+	command.Stderr = &errBuf
+	bb, err := command.Output()
+	if err != nil {
+		return nil, fmt.Errorf("age: %w: %s", err, strings.TrimSpace(errBuf.String()))
+	}
+	return bb, nil
+}
@@ -0,0 +1,139 @@
+package fleek
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// ExportPackagesList writes the configured packages to w,
+// one package name per line. If withBling is true the
+// packages provided by the configured bling level are
+// written after the user packages.
+func (c *Config) ExportPackagesList(w io.Writer, withBling bool) error {
+	packages := c.Packages
+	if withBling {
+		var err error
+		packages, err = c.EffectivePackages()
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range packages {
+		_, err := fmt.Fprintln(w, p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportPackagesList reads package names from r, one per
+// line, and adds any that aren't already configured.
+// Blank lines and lines starting with `#` are ignored.
+// The configuration is validated and saved once, and the
+// newly added packages are returned.
+func (c *Config) ImportPackagesList(r io.Reader) (added []string, err error) {
+	if c.Locked {
+		return nil, ErrConfigLocked
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if isValueInList(line, c.Packages) {
+			continue
+		}
+		c.Packages = append(c.Packages, line)
+		added = append(added, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(added) == 0 {
+		return added, nil
+	}
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return added, c.Save()
+}
+
+// Sanitize returns a copy of the configuration that is safe
+// to publish as a starting point for others. Systems, users
+// and workspaces are removed, along with absolute paths,
+// modules and secrets that only exist on this machine, and
+// Base when it's a local path. If stripRemotes is true, Base,
+// modules and package sets that are flake references are
+// removed too, so the repositories they point at aren't
+// published. The configuration is unchanged.
+func (c *Config) Sanitize(stripRemotes bool) (*Config, error) {
+	s, err := c.clone()
+	if err != nil {
+		return nil, err
+	}
+	s.Systems = nil
+	s.Users = nil
+	s.Workspaces = nil
+	s.Workspace = ""
+	local := func(p string) bool { return !filepath.IsAbs(p) && !strings.HasPrefix(p, "~") }
+	s.Paths = lo.Filter(s.Paths, func(p string, _ int) bool { return local(p) })
+	s.Modules = lo.Filter(s.Modules, func(m string, _ int) bool {
+		if isFlakeRef(m) {
+			return !stripRemotes
+		}
+		return local(m)
+	})
+	for name, file := range s.Secrets {
+		if !local(file) {
+			delete(s.Secrets, name)
+		}
+	}
+	if s.Base != "" && (!isFlakeRef(s.Base) || stripRemotes) {
+		s.Base = ""
+	}
+	if stripRemotes {
+		s.PackageSets = nil
+	}
+	return s, nil
+}
+
+// ImportFromCommand runs cmd with `sh -c` and maps each
+// line of its output to a nixpkgs package name with mapFn,
+// so the result can be passed to AddPackages. Lines that
+// map to an empty name are skipped. A nil mapFn uses each
+// trimmed line as the package name.
+func ImportFromCommand(cmd string, mapFn func(string) string) ([]string, error) {
+	if mapFn == nil {
+		mapFn = func(line string) string { return line }
+	}
+	command := exec.Command("sh", "-c", cmd)
+	command.Env = os.Environ()
+	command.Stderr = os.Stderr
+	bb, err := command.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cmd, err)
+	}
+	var packages []string
+	scanner := bufio.NewScanner(bytes.NewReader(bb))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if name := strings.TrimSpace(mapFn(line)); name != "" && !isValueInList(name, packages) {
+			packages = append(packages, name)
+		}
+	}
+	return packages, scanner.Err()
+}
@@ -0,0 +1,38 @@
+package fleek
+
+import (
+	"net/url"
+	"strings"
+)
+
+// flakeRefSchemes are the flake reference types
+// accepted in the configuration.
+var flakeRefSchemes = []string{
+	"github", "gitlab", "sourcehut",
+	"git+https", "git+ssh", "git+http", "git+file",
+	"hg+https", "hg+ssh", "hg+http", "hg+file",
+	"path", "file", "tarball+https", "tarball+http", "tarball+file",
+	"https", "http", "flake",
+}
+
+// IsValidFlakeRef reports whether ref is a well-formed
+// URL-like flake reference, e.g. `github:owner/repo` or
+// `git+https://example.com/repo.git`.
+func IsValidFlakeRef(ref string) bool {
+	u, err := url.Parse(ref)
+	if err != nil || u.Scheme == "" {
+		return false
+	}
+	if !isValueInList(u.Scheme, flakeRefSchemes) {
+		return false
+	}
+	switch u.Scheme {
+	case "github", "gitlab", "sourcehut":
+		parts := strings.Split(u.Opaque, "/")
+		return len(parts) >= 2 && parts[0] != "" && parts[1] != ""
+	case "path", "flake":
+		return u.Opaque != "" || u.Path != ""
+	default:
+		return u.Host != "" || u.Path != ""
+	}
+}
@@ -1,14 +1,129 @@
 package fleek
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"github.com/samber/lo"
+	"github.com/ublue-os/fleek/fin"
+	"github.com/ublue-os/fleek/internal/envir"
+	"github.com/ublue-os/fleek/internal/xdg"
 )
 
 // ConfigLocation returns the path for the
-// fleek configuration file.
+// fleek configuration file. The FLEEK_CONFIG
+// environment variable overrides the default.
 func (c *Config) Location() (string, error) {
-	return filepath.Join(c.UserFlakeDir(), ".fleek.yml"), nil
+	if override := os.Getenv(envir.ConfigPath); override != "" {
+		if IsDir(override) {
+			return filepath.Join(override, ".fleek.yml"), nil
+		}
+		return override, nil
+	}
+	return filepath.Join(c.configFlakeDir(), ".fleek.yml"), nil
+}
+
+// InsideFlakeDir reports whether cwd is the flake
+// directory or one of its subdirectories.
+func (c *Config) InsideFlakeDir(cwd string) bool {
+	rel, err := filepath.Rel(canonicalPath(c.UserFlakeDir()), canonicalPath(cwd))
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// ManagedPaths returns every path fleek manages: the
+// configuration file, the $HOME/.fleek.yml symlink, the flake
+// directory and any workspace directories, the log file and
+// the cache directory. Paths are listed whether or not they
+// exist. Backups home-manager makes with the `.bak` suffix
+// live beside the files they replaced and aren't included.
+func (c *Config) ManagedPaths() []string {
+	var paths []string
+	if cfile, err := c.Location(); err == nil {
+		paths = append(paths, cfile)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".fleek.yml"))
+		for _, name := range lo.Keys(c.Workspaces) {
+			paths = append(paths, filepath.Join(home, c.Workspaces[name]))
+		}
+	}
+	paths = append(paths,
+		c.configFlakeDir(),
+		filepath.Join(c.configFlakeDir(), ".fleek.log"),
+		xdg.CacheSubpath("fleek"),
+	)
+	return lo.Uniq(paths)
+}
+
+// ErrNotFleekFlake is returned by Uninstall when asked to
+// remove a flake directory fleek didn't generate.
+var ErrNotFleekFlake = errors.New("flake directory was not created by fleek, refusing to remove it")
+
+// ErrEjectedFlake is returned by Uninstall when asked to
+// remove an ejected flake directory, which may hold edits
+// that only exist there.
+var ErrEjectedFlake = errors.New("flake directory was ejected and may have been edited by hand, refusing to remove it")
+
+// Uninstall removes the $HOME/.fleek.yml symlink, the log
+// file and the cache directory, and the flake directory when
+// removeFlakeDir is true, its flake.nix was generated by
+// fleek and it wasn't ejected. It returns the paths removed. Installed packages are
+// left alone; run `home-manager uninstall` to remove them.
+func (c *Config) Uninstall(removeFlakeDir bool) (removed []string, err error) {
+	if c.Locked {
+		return nil, ErrConfigLocked
+	}
+	dir := c.configFlakeDir()
+	if removeFlakeDir && c.Ejected {
+		return nil, fmt.Errorf("%w: %s", ErrEjectedFlake, dir)
+	}
+	if removeFlakeDir && IsDir(dir) {
+		bb, err := os.ReadFile(filepath.Join(dir, "flake.nix"))
+		if err != nil || !strings.Contains(string(bb), "managed by fleek") {
+			return nil, fmt.Errorf("%w: %s", ErrNotFleekFlake, dir)
+		}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	link := filepath.Join(home, ".fleek.yml")
+	if info, err := os.Lstat(link); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(link); err != nil {
+			return removed, err
+		}
+		removed = append(removed, link)
+	}
+	targets := []string{filepath.Join(dir, ".fleek.log"), xdg.CacheSubpath("fleek")}
+	if removeFlakeDir {
+		targets = append(targets, dir)
+	}
+	for _, p := range targets {
+		if !Exists(p) {
+			continue
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return removed, err
+		}
+		removed = append(removed, p)
+	}
+	fin.Logger.Warn("installed packages were not removed, run `home-manager uninstall` to remove them")
+	return removed, nil
+}
+
+// ConfigOverride returns the value of the FLEEK_CONFIG
+// environment variable and whether it names an existing
+// regular file, in which case the $HOME/.fleek.yml
+// symlink isn't used.
+func ConfigOverride() (string, bool) {
+	override := os.Getenv(envir.ConfigPath)
+	return override, override != "" && IsFile(override)
 }
 
 // GitLocation returns the path for the
@@ -0,0 +1,115 @@
+package fleek
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ConflictStrategy decides which value Merge keeps when
+// both configurations set a field to different values.
+type ConflictStrategy int
+
+const (
+	// ConflictError rejects the merge and reports the
+	// conflicting fields. It is the default strategy.
+	ConflictError ConflictStrategy = iota
+	// TheirsWin keeps the value from the other configuration.
+	TheirsWin
+	// OursWin keeps the value from this configuration.
+	OursWin
+)
+
+var ErrMergeConflict = errors.New("merge conflict")
+
+// Merge combines other into the configuration using strategy
+// to settle conflicts. The merged configuration isn't saved.
+//
+//   - Lists (packages, programs, paths, blocklist, systems...)
+//     are unioned and never conflict.
+//   - Maps (aliases, overlays, secrets...) are merged key by
+//     key. A key set in both to different values is a conflict.
+//   - Scalars (shell, bling, name, track, flags...) conflict when
+//     both are set and differ. Unset values take the other value.
+//
+// With ConflictError the configuration is left unchanged and
+// the error lists every conflicting field.
+func (c *Config) Merge(other *Config, strategy ConflictStrategy) error {
+	merged, err := c.clone()
+	if err != nil {
+		return err
+	}
+	var conflicts []string
+	merge(reflect.ValueOf(merged).Elem(), reflect.ValueOf(other).Elem(), strategy, "", &conflicts)
+	if len(conflicts) > 0 && strategy == ConflictError {
+		return fmt.Errorf("%w: %s", ErrMergeConflict, strings.Join(conflicts, ", "))
+	}
+	c.copyState(merged)
+	*c = *merged
+	return nil
+}
+
+// yamlName returns the key a field is stored under.
+func yamlName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+	if name == "" {
+		name = strings.ToLower(f.Name)
+	}
+	return name
+}
+
+func merge(dst, src reflect.Value, strategy ConflictStrategy, prefix string, conflicts *[]string) {
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+		if !serialized(field) {
+			continue
+		}
+		name := prefix + yamlName(field)
+		d, s := dst.Field(i), src.Field(i)
+		switch d.Kind() {
+		case reflect.Struct:
+			merge(d, s, strategy, name+".", conflicts)
+		case reflect.Slice:
+			for j := 0; j < s.Len(); j++ {
+				if !containsValue(d, s.Index(j)) {
+					d.Set(reflect.Append(d, s.Index(j)))
+				}
+			}
+		case reflect.Map:
+			if s.Len() == 0 {
+				continue
+			}
+			if d.IsNil() {
+				d.Set(reflect.MakeMap(d.Type()))
+			}
+			iter := s.MapRange()
+			for iter.Next() {
+				ours := d.MapIndex(iter.Key())
+				if !ours.IsValid() {
+					d.SetMapIndex(iter.Key(), iter.Value())
+					continue
+				}
+				if reflect.DeepEqual(ours.Interface(), iter.Value().Interface()) {
+					continue
+				}
+				*conflicts = append(*conflicts, fmt.Sprintf("%s.%v", name, iter.Key().Interface()))
+				if strategy == TheirsWin {
+					d.SetMapIndex(iter.Key(), iter.Value())
+				}
+			}
+		default:
+			if s.IsZero() || reflect.DeepEqual(d.Interface(), s.Interface()) {
+				continue
+			}
+			if d.IsZero() {
+				d.Set(s)
+				continue
+			}
+			*conflicts = append(*conflicts, name)
+			if strategy == TheirsWin {
+				d.Set(s)
+			}
+		}
+	}
+}
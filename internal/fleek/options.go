@@ -0,0 +1,65 @@
+package fleek
+
+import "github.com/ublue-os/fleek/internal/xdg"
+
+// ConfigOption sets a value on a Config built by NewConfig.
+type ConfigOption func(*Config)
+
+// WithFlakeDir sets the flake directory, relative to $HOME.
+func WithFlakeDir(dir string) ConfigOption {
+	return func(c *Config) {
+		c.FlakeDir = dir
+	}
+}
+
+// WithShell sets the shell.
+func WithShell(shell string) ConfigOption {
+	return func(c *Config) {
+		c.Shell = shell
+	}
+}
+
+// WithBling sets the bling level.
+func WithBling(level string) ConfigOption {
+	return func(c *Config) {
+		c.Bling = level
+	}
+}
+
+// WithPackages adds packages, skipping duplicates.
+func WithPackages(packs ...string) ConfigOption {
+	return func(c *Config) {
+		for _, p := range packs {
+			if !isValueInList(p, c.Packages) {
+				c.Packages = append(c.Packages, p)
+			}
+		}
+	}
+}
+
+// WithSystem adds a system.
+func WithSystem(sys *System) ConfigOption {
+	return func(c *Config) {
+		c.Systems = append(c.Systems, sys)
+	}
+}
+
+// NewConfig returns a validated Config with the default
+// flake directory, the shell from $SHELL (see DetectShell)
+// and the default bling level, modified by opts. Nothing
+// is written to disk.
+func NewConfig(opts ...ConfigOption) (*Config, error) {
+	c := &Config{
+		FlakeDir: xdg.DataSubpathRel("fleek"),
+		Shell:    DetectShell(),
+		Bling:    "default",
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	err := c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,108 @@
+package fleek
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// RemoteTimeout limits how long fetching a remote
+// configuration file over http may take.
+var RemoteTimeout = 30 * time.Second
+
+// MergeRemote adds packages and programs from the
+// configuration at url to this one, then validates and
+// saves it. A url ending in .yml or .yaml is fetched over
+// http, anything else is fetched as a flake reference or
+// git repository holding a configuration file. When only is
+// empty every remote package and program is added, otherwise
+// just the named ones, each of which must be in the remote
+// configuration. Nothing else from the remote is used.
+func (c *Config) MergeRemote(url string, only []string) error {
+	if c.Locked {
+		return ErrConfigLocked
+	}
+	remote, err := readRemoteConfig(url)
+	if err != nil {
+		return err
+	}
+	packages, programs := remote.Packages, remote.Programs
+	if len(only) > 0 {
+		packages, programs = nil, nil
+		for _, name := range only {
+			switch {
+			case isValueInList(name, remote.Packages):
+				packages = append(packages, name)
+			case isValueInList(name, remote.Programs):
+				programs = append(programs, name)
+			default:
+				return fmt.Errorf("%w: %s in %s", ErrPackageNotFound, name, url)
+			}
+		}
+	}
+	var added bool
+	for _, p := range packages {
+		if !isValueInList(p, c.Packages) {
+			c.Packages = append(c.Packages, p)
+			added = true
+		}
+	}
+	for _, p := range programs {
+		if !isValueInList(p, c.Programs) {
+			c.Programs = append(c.Programs, p)
+			added = true
+		}
+	}
+	if !added {
+		return nil
+	}
+	err = c.Validate()
+	if err != nil {
+		return err
+	}
+	return c.Save()
+}
+
+// readRemoteConfig fetches and parses the configuration
+// at url, see MergeRemote.
+func readRemoteConfig(url string) (*Config, error) {
+	if OfflineMode {
+		return nil, ErrOfflineMode
+	}
+	ext := path.Ext(url)
+	if ext != ".yml" && ext != ".yaml" {
+		ref := url
+		if strings.HasPrefix(ref, "https://") || strings.HasPrefix(ref, "http://") {
+			ref = "git+" + ref
+		}
+		dir, err := prefetchFlake(ref)
+		if err != nil {
+			return nil, err
+		}
+		loc, err := findConfigFile(dir)
+		if err != nil {
+			return nil, err
+		}
+		return readConfigFile(loc, false)
+	}
+	client := http.Client{Timeout: RemoteTimeout}
+	res, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, res.Status)
+	}
+	bb, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if isEncrypted(bb) {
+		return nil, ErrConfigEncrypted
+	}
+	return parseConfig(url, bb, false)
+}
@@ -0,0 +1,79 @@
+package fleek
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// schemaEnums are the allowed values of string settings,
+// keyed by their name in the configuration file.
+var schemaEnums = map[string]*[]string{
+	"shell": &shells,
+	"arch":  &architectures,
+	"os":    &operatingSystems,
+}
+
+// schemaPatterns are the regular expressions string
+// settings must match, keyed like schemaEnums.
+var schemaPatterns = map[string]string{
+	"state_version": stateVersion.String(),
+}
+
+// ConfigJSONSchema returns a JSON Schema for the
+// configuration file, generated from the Config struct,
+// for editors using yaml-language-server. Bling also
+// accepts the names of extra_tiers, so it isn't
+// restricted to the built-in levels.
+func ConfigJSONSchema() []byte {
+	schema := typeSchema(reflect.TypeOf(Config{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "fleek.yml"
+	props := schema["properties"].(map[string]interface{})
+	props["bling"] = map[string]interface{}{
+		"type":     "string",
+		"examples": blingLevels,
+	}
+	// the schema only holds maps, slices and strings
+	bb, _ := json.MarshalIndent(schema, "", "  ")
+	return bb
+}
+
+// typeSchema returns the schema for values of type t.
+func typeSchema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !serialized(field) {
+				continue
+			}
+			name := yamlName(field)
+			prop := typeSchema(field.Type)
+			if enum, ok := schemaEnums[name]; ok && field.Type.Kind() == reflect.String {
+				prop["enum"] = *enum
+			}
+			if pattern, ok := schemaPatterns[name]; ok && field.Type.Kind() == reflect.String {
+				prop["pattern"] = pattern
+			}
+			props[name] = prop
+		}
+		return map[string]interface{}{"type": "object", "properties": props, "additionalProperties": false}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
@@ -0,0 +1,141 @@
+package fleek
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrRoundTrip     = errors.New("field does not survive save")
+	ErrBrokenSymlink = errors.New("~/.fleek.yml symlink is broken")
+	ErrWrongSymlink  = errors.New("~/.fleek.yml symlink does not point to the configuration file")
+	ErrNoFlakeDir    = errors.New("flake directory does not exist")
+	ErrNotOwner      = errors.New("not owned by the current user")
+	ErrNotWritable   = errors.New("not writable by the current user")
+)
+
+// CheckPermissions verifies that the configuration file
+// and the ~/.fleek.yml symlink, if there is one, are owned
+// by the current user and that the configuration file is
+// writable, so Save won't fail part way through.
+func (c *Config) CheckPermissions() error {
+	cfile, err := c.Location()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	if err := checkOwner(cfile, os.Stat); err != nil {
+		errs = append(errs, err)
+	}
+	// W_OK
+	if err := syscall.Access(cfile, 2); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w, run `sudo chmod u+w %s`", cfile, ErrNotWritable, cfile))
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	link := filepath.Join(home, ".fleek.yml")
+	if info, err := os.Lstat(link); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := checkOwner(link, os.Lstat); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkOwner returns an error if the file at path,
+// read with stat, isn't owned by the current user.
+func checkOwner(path string, stat func(string) (os.FileInfo, error)) error {
+	info, err := stat(path)
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s: %w, run `sudo chown -h %d %s`", path, ErrNotOwner, os.Getuid(), path)
+	}
+	return nil
+}
+
+// SelfTest checks that the configuration survives being
+// saved and read again, that the ~/.fleek.yml symlink
+// points at the configuration file, and that the flake
+// directory exists. Nothing is written to disk. All
+// problems found are returned together.
+func (c *Config) SelfTest() error {
+	var errs []error
+	errs = append(errs, c.roundTrip()...)
+	if err := c.checkSymlink(); err != nil {
+		errs = append(errs, err)
+	}
+	if !IsDir(c.UserFlakeDir()) {
+		errs = append(errs, fmt.Errorf("%w: %s", ErrNoFlakeDir, c.UserFlakeDir()))
+	}
+	return errors.Join(errs...)
+}
+
+// roundTrip marshals the configuration the same way Save
+// does and reports any field that reads back differently.
+func (c *Config) roundTrip() []error {
+	local, _, err := c.localLayer()
+	if err != nil {
+		return []error{err}
+	}
+	bb, err := c.marshal()
+	if err != nil {
+		return []error{err}
+	}
+	read := &Config{}
+	err = yaml.Unmarshal(bb, read)
+	if err != nil {
+		return []error{err}
+	}
+	var errs []error
+	want, got := reflect.ValueOf(local).Elem(), reflect.ValueOf(read).Elem()
+	for i := 0; i < want.NumField(); i++ {
+		field := want.Type().Field(i)
+		if !serialized(field) {
+			continue
+		}
+		if !reflect.DeepEqual(want.Field(i).Interface(), got.Field(i).Interface()) {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrRoundTrip, yamlName(field)))
+		}
+	}
+	return errs
+}
+
+// checkSymlink verifies that ~/.fleek.yml, if it is a
+// symlink, resolves to the configuration file.
+func (c *Config) checkSymlink() error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	link := filepath.Join(home, ".fleek.yml")
+	info, err := os.Lstat(link)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	target, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBrokenSymlink, err)
+	}
+	cfile, err := c.Location()
+	if err != nil {
+		return err
+	}
+	if target != canonicalPath(cfile) {
+		return fmt.Errorf("%w: points to %s, expected %s", ErrWrongSymlink, target, cfile)
+	}
+	return nil
+}
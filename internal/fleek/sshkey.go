@@ -0,0 +1,47 @@
+package fleek
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// EnsureGitSSHKey returns the public key of ~/.ssh/id_ed25519,
+// generating the key pair with ssh-keygen first if it doesn't
+// exist. An existing key is never overwritten. The key is
+// commented with the local user's email when it's known.
+func (c *Config) EnsureGitSSHKey() (pubkey string, err error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	private := filepath.Join(home, ".ssh", "id_ed25519")
+	public := private + ".pub"
+	if !Exists(private) {
+		err = os.MkdirAll(filepath.Dir(private), 0700)
+		if err != nil {
+			return "", err
+		}
+		args := []string{"-q", "-t", "ed25519", "-N", "", "-f", private}
+		if sys, err := c.LocalSystem(); err == nil && sys.User != nil && sys.User.Email != "" {
+			args = append(args, "-C", sys.User.Email)
+		}
+		command := exec.Command("ssh-keygen", args...)
+		command.Env = os.Environ()
+		out, err := command.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("ssh-keygen: %w: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	bb, err := os.ReadFile(public)
+	if err != nil {
+		// the public key can be recovered from the private key
+		bb, err = exec.Command("ssh-keygen", "-y", "-f", private).Output()
+		if err != nil {
+			return "", fmt.Errorf("ssh-keygen: %w", err)
+		}
+	}
+	return strings.TrimSpace(string(bb)), nil
+}
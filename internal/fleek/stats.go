@@ -0,0 +1,155 @@
+package fleek
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ConfigStats holds summary counts for a configuration.
+type ConfigStats struct {
+	Packages          int `json:"packages"`
+	Programs          int `json:"programs"`
+	Aliases           int `json:"aliases"`
+	Paths             int `json:"paths"`
+	Systems           int `json:"systems"`
+	EffectivePackages int `json:"effective_packages"`
+}
+
+// EffectivePackages returns the user packages followed by
+// the packages supplied by the configured bling level.
+func (c *Config) EffectivePackages() ([]string, error) {
+	packages := append([]string{}, c.Packages...)
+	b, err := c.CurrentBling()
+	if err != nil {
+		return packages, err
+	}
+	for _, p := range b.FinalPackages(c) {
+		if !isValueInList(p, packages) {
+			packages = append(packages, p)
+		}
+	}
+	return packages, nil
+}
+
+// Stats returns counts of the entries in the configuration.
+func (c *Config) Stats() ConfigStats {
+	// the embedded bling sets always load, so the
+	// package list is still usable on error
+	effective, _ := c.EffectivePackages()
+	return ConfigStats{
+		Packages:          len(c.Packages),
+		Programs:          len(c.Programs),
+		Aliases:           len(c.Aliases),
+		Paths:             len(c.Paths),
+		Systems:           len(c.Systems),
+		EffectivePackages: len(effective),
+	}
+}
+
+// PackageSources returns the effective packages grouped by
+// the source that contributes them: "user" for the
+// configured package list, "bling" for packages added by
+// the bling level, "package_sets" for the flake
+// references whose default package is installed and
+// "system:<hostname>" for the packages a system's
+// specialisations add. Sources that contribute nothing
+// are omitted.
+func (c *Config) PackageSources() map[string][]string {
+	sources := make(map[string][]string)
+	if len(c.Packages) > 0 {
+		sources["user"] = append([]string{}, c.Packages...)
+	}
+	if b, err := c.CurrentBling(); err == nil {
+		var bling []string
+		for _, p := range b.FinalPackages(c) {
+			if !isValueInList(p, c.Packages) {
+				bling = append(bling, p)
+			}
+		}
+		if len(bling) > 0 {
+			sources["bling"] = bling
+		}
+	}
+	if len(c.PackageSets) > 0 {
+		sources["package_sets"] = append([]string{}, c.PackageSets...)
+	}
+	for _, sys := range c.Systems {
+		var packages []string
+		for _, packs := range sys.Specialisations {
+			for _, p := range packs {
+				if !isValueInList(p, packages) {
+					packages = append(packages, p)
+				}
+			}
+		}
+		if len(packages) > 0 {
+			sort.Strings(packages)
+			sources["system:"+sys.Hostname] = packages
+		}
+	}
+	return sources
+}
+
+// PackageOrigin explains where the package name comes
+// from: "user" for the configured package list, "base"
+// when it's only listed in the Base configuration,
+// "bling:<level>" for the bling level, "package_set" for
+// a package set reference and "system:<hostname>" for a
+// system's specialisations. A package with more than one
+// origin lists each, separated by commas.
+func (c *Config) PackageOrigin(name string) (string, error) {
+	var origins []string
+	if isValueInList(name, c.Packages) {
+		if c.base != nil && isValueInList(name, c.base.Packages) {
+			origins = append(origins, "base")
+		} else {
+			origins = append(origins, "user")
+		}
+	}
+	if b, err := c.CurrentBling(); err == nil && isValueInList(name, b.FinalPackages(c)) {
+		origins = append(origins, "bling:"+c.Bling)
+	}
+	if isValueInList(name, c.PackageSets) {
+		origins = append(origins, "package_set")
+	}
+	for _, sys := range c.Systems {
+		for _, packs := range sys.Specialisations {
+			if isValueInList(name, packs) {
+				origins = append(origins, "system:"+sys.Hostname)
+				break
+			}
+		}
+	}
+	if len(origins) == 0 {
+		return "", fmt.Errorf("%w: %s", ErrPackageNotFound, name)
+	}
+	return strings.Join(origins, ", "), nil
+}
+
+// ExcludedSystems returns the nix system doubles
+// ExcludePackages leaves the package name out on, sorted.
+func (c *Config) ExcludedSystems(name string) []string {
+	var systems []string
+	for double, packs := range c.ExcludePackages {
+		if isValueInList(name, packs) {
+			systems = append(systems, double)
+		}
+	}
+	sort.Strings(systems)
+	return systems
+}
+
+// PlatformPackages returns the user and bling packages
+// that are excluded on some systems, mapped to the
+// systems they're left out on.
+func (c *Config) PlatformPackages() map[string][]string {
+	packages, _ := c.EffectivePackages()
+	platform := make(map[string][]string)
+	for _, p := range packages {
+		if systems := c.ExcludedSystems(p); len(systems) > 0 {
+			platform[p] = systems
+		}
+	}
+	return platform
+}
@@ -4,15 +4,90 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 
 	"os/user"
 
+	"github.com/samber/lo"
 	"github.com/ublue-os/fleek/fin"
 )
 
-var ErrSysNotFound = errors.New("system not found")
+var (
+	ErrSysNotFound   = errors.New("system not found")
+	ErrEmptyKeepList = errors.New("refusing to remove every system, keep list is empty")
+	ErrNoLocalSystem = errors.New("no system matches the local hostname")
+	ErrMultipleLocal = errors.New("more than one system matches the local hostname")
+	ErrNoHostname    = errors.New("fleek.yml: system is missing a hostname")
+	ErrNoUsername    = errors.New("fleek.yml: system is missing a username")
+	ErrInvalidEmail  = errors.New("fleek.yml: invalid git email address")
+	ErrDupSystem     = errors.New("system already exists")
+	ErrEmptyTag      = errors.New("fleek.yml: system has an empty tag")
+	ErrEmptyPlatform = errors.New("architecture or operating system name is empty")
+	ErrDupPlatform   = errors.New("architecture or operating system is already registered")
+)
+
+// RegisterArchitecture adds name to the architectures
+// accepted by Validate.
+func RegisterArchitecture(name string) error {
+	return registerPlatform(&architectures, name)
+}
+
+// RegisterOperatingSystem adds name to the operating
+// systems accepted by Validate.
+func RegisterOperatingSystem(name string) error {
+	return registerPlatform(&operatingSystems, name)
+}
+
+func registerPlatform(list *[]string, name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ErrEmptyPlatform
+	}
+	if isValueInList(name, *list) {
+		return fmt.Errorf("%w: %s", ErrDupPlatform, name)
+	}
+	*list = append(*list, name)
+	return nil
+}
+
+// Validate checks a single system independently of
+// the rest of the configuration.
+func (s System) Validate() error {
+	if s.Hostname == "" {
+		return ErrNoHostname
+	}
+	if s.Username == "" {
+		return fmt.Errorf("%w: %s", ErrNoUsername, s.Hostname)
+	}
+	if !isValueInList(s.Arch, architectures) {
+		return ErrorInvalidArch
+	}
+	if !isValueInList(s.OS, operatingSystems) {
+		return ErrInvalidOperatingSystem
+	}
+	if s.StateVersion != "" && !stateVersion.MatchString(s.StateVersion) {
+		return fmt.Errorf("%w: %s", ErrInvalidStateVersion, s.Hostname)
+	}
+	if isValueInList("", lo.Map(s.Tags, func(t string, _ int) string { return strings.TrimSpace(t) })) {
+		return fmt.Errorf("%w: %s", ErrEmptyTag, s.Hostname)
+	}
+	if s.User != nil && s.User.Email != "" && !strings.Contains(s.User.Email, "@") {
+		return fmt.Errorf("%w: %s", ErrInvalidEmail, s.User.Email)
+	}
+	for name, packs := range s.Specialisations {
+		if !identifierName.MatchString(name) {
+			return fmt.Errorf("%w: %s", ErrInvalidSpecialisation, name)
+		}
+		for _, p := range packs {
+			if !validName(p) {
+				return fmt.Errorf("%w: %s: %q", ErrInvalidPackageName, name, p)
+			}
+		}
+	}
+	return nil
+}
 
 func Runtime() string {
 	arch := runtime.GOARCH
@@ -68,6 +143,61 @@ func Hostname() (string, error) {
 	return h, nil
 }
 
+// ShortHostname returns host up to the first dot,
+// so a fully qualified name matches its short form.
+func ShortHostname(host string) string {
+	short, _, _ := strings.Cut(host, ".")
+	return short
+}
+
+// SameHost reports whether a and b name the same machine,
+// comparing short hostnames case-insensitively.
+func SameHost(a, b string) bool {
+	return strings.EqualFold(ShortHostname(a), ShortHostname(b))
+}
+
+// System returns the system with hostname. An exact match
+// is preferred, otherwise hostname is matched against each
+// system's short hostname, so a fully qualified name finds
+// a system stored with its short name and the reverse.
+func (c *Config) System(hostname string) (*System, error) {
+	for _, sys := range c.Systems {
+		if sys.Hostname == hostname {
+			return sys, nil
+		}
+	}
+	for _, sys := range c.Systems {
+		if SameHost(sys.Hostname, hostname) {
+			return sys, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrSysNotFound, hostname)
+}
+
+// isWSL reports whether fleek is running under
+// the Windows Subsystem for Linux.
+func isWSL() bool {
+	bb, err := os.ReadFile("/proc/version")
+	if err != nil {
+		return false
+	}
+	return strings.Contains(strings.ToLower(string(bb)), "microsoft")
+}
+
+// isLocal reports whether s describes the current
+// user on the current machine.
+func (s System) isLocal() bool {
+	host, err := Hostname()
+	if err != nil {
+		return false
+	}
+	user, err := Username()
+	if err != nil {
+		return false
+	}
+	return SameHost(s.Hostname, host) && s.Username == user
+}
+
 func (c *Config) CurrentSystem() (*System, error) {
 
 	host, err := Hostname()
@@ -79,7 +209,7 @@ func (c *Config) CurrentSystem() (*System, error) {
 		return nil, fmt.Errorf("getting username: %w", err)
 	}
 	for _, sys := range c.Systems {
-		if sys.Hostname == host {
+		if SameHost(sys.Hostname, host) {
 			if sys.Username == user {
 				return sys, nil
 			}
@@ -88,6 +218,186 @@ func (c *Config) CurrentSystem() (*System, error) {
 	return nil, ErrSysNotFound
 }
 
+// RemoveSystemsForUser removes every system registered
+// to username and saves the configuration. It returns the
+// number of systems removed, or ErrSysNotFound if none matched.
+func (c *Config) RemoveSystemsForUser(username string) (int, error) {
+	if c.Locked {
+		return 0, ErrConfigLocked
+	}
+	kept := make([]*System, 0, len(c.Systems))
+	for _, sys := range c.Systems {
+		if sys.Username != username {
+			kept = append(kept, sys)
+		}
+	}
+	removed := len(c.Systems) - len(kept)
+	if removed == 0 {
+		return 0, ErrSysNotFound
+	}
+	c.Systems = kept
+	err := c.Validate()
+	if err != nil {
+		return 0, err
+	}
+	return removed, c.Save()
+}
+
+// PruneSystems removes every system whose hostname isn't
+// in keep and saves the configuration, returning the removed
+// systems. An empty keep list is rejected with ErrEmptyKeepList.
+func (c *Config) PruneSystems(keep []string) (removed []System, err error) {
+	if len(keep) == 0 {
+		return nil, ErrEmptyKeepList
+	}
+	if c.Locked {
+		return nil, ErrConfigLocked
+	}
+	kept := make([]*System, 0, len(c.Systems))
+	for _, sys := range c.Systems {
+		if isValueInList(sys.Hostname, keep) {
+			kept = append(kept, sys)
+			continue
+		}
+		removed = append(removed, *sys)
+	}
+	if len(removed) == 0 {
+		return removed, nil
+	}
+	c.Systems = kept
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return removed, c.Save()
+}
+
+// ExpandSystemTemplate adds a copy of base for each of
+// hostnames, then validates and saves the configuration.
+// Nothing is added if a hostname is repeated or already
+// configured for the same user.
+func (c *Config) ExpandSystemTemplate(base System, hostnames []string) error {
+	if c.Locked {
+		return ErrConfigLocked
+	}
+	seen := make(map[string]bool, len(hostnames))
+	for _, sys := range c.Systems {
+		if sys.Username == base.Username {
+			seen[sys.Hostname] = true
+		}
+	}
+	systems := make([]*System, 0, len(hostnames))
+	for _, host := range hostnames {
+		if seen[host] {
+			return fmt.Errorf("%w: %s@%s", ErrDupSystem, base.Username, host)
+		}
+		seen[host] = true
+		sys := base
+		sys.Hostname = host
+		if base.User != nil {
+			user := *base.User
+			sys.User = &user
+		}
+		systems = append(systems, &sys)
+	}
+	c.Systems = append(c.Systems, systems...)
+	err := c.Validate()
+	if err != nil {
+		return err
+	}
+	return c.Save()
+}
+
+// GetSystem returns a copy of the system with hostname,
+// found like System, or ErrSysNotFound.
+func (c *Config) GetSystem(hostname string) (System, error) {
+	sys, err := c.System(hostname)
+	if err != nil {
+		return System{}, err
+	}
+	return *sys, nil
+}
+
+// UpdateSystem calls fn on the system with hostname, found
+// like System, then validates and saves the configuration.
+// If the result doesn't validate the system is left
+// unchanged.
+func (c *Config) UpdateSystem(hostname string, fn func(*System)) error {
+	if c.Locked {
+		return ErrConfigLocked
+	}
+	sys, err := c.System(hostname)
+	if err != nil {
+		return err
+	}
+	original := *sys
+	if sys.User != nil {
+		user := *sys.User
+		original.User = &user
+	}
+	fn(sys)
+	err = c.Validate()
+	if err != nil {
+		*sys = original
+		return err
+	}
+	return c.Save()
+}
+
+// SystemsByTag returns the systems tagged with tag.
+func (c *Config) SystemsByTag(tag string) []System {
+	var systems []System
+	for _, sys := range c.Systems {
+		if isValueInList(tag, sys.Tags) {
+			systems = append(systems, *sys)
+		}
+	}
+	return systems
+}
+
+// ActiveSystemsOnly returns a copy of the configuration
+// containing only the systems for the local hostname, so
+// generating the flake doesn't evaluate every system in a
+// shared configuration. Saving the copy would drop the
+// other systems; the configuration is unchanged.
+func (c *Config) ActiveSystemsOnly() (*Config, error) {
+	host, err := Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("getting hostname: %w", err)
+	}
+	active, err := c.clone()
+	if err != nil {
+		return nil, err
+	}
+	active.Systems = lo.Filter(active.Systems, func(sys *System, _ int) bool { return SameHost(sys.Hostname, host) })
+	return active, nil
+}
+
+// LocalSystem returns the system whose hostname matches
+// the current machine, comparing short hostnames. It
+// returns ErrNoLocalSystem when none match and
+// ErrMultipleLocal when more than one does.
+func (c *Config) LocalSystem() (*System, error) {
+	host, err := Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("getting hostname: %w", err)
+	}
+	var local *System
+	for _, sys := range c.Systems {
+		if !SameHost(sys.Hostname, host) {
+			continue
+		}
+		if local != nil {
+			return nil, fmt.Errorf("%w: %s", ErrMultipleLocal, host)
+		}
+		local = sys
+	}
+	if local == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoLocalSystem, host)
+	}
+	return local, nil
+}
+
 func UserShell() (string, error) {
 	// modified from https://github.com/captainsafia/go-user-shell/blob/master/user_shell.go
 	// MIT License
@@ -124,6 +434,33 @@ func UserShell() (string, error) {
 
 }
 
+// DetectShell returns the user's shell, see UserShell, if
+// fleek supports it, otherwise bash with a warning.
+func DetectShell() string {
+	shell, _ := UserShell()
+	shell = filepath.Base(shell)
+	if !isValueInList(shell, shells) {
+		fin.Logger.Warn("unsupported shell, using bash", fin.Logger.Args("shell", shell, "supported", strings.Join(shells, ", ")))
+		return "bash"
+	}
+	return shell
+}
+
 func MkdirAll(path string) error {
 	return os.Mkdir(path, 0755)
 }
+
+// NixFiles returns the system's files with each source
+// converted to a nix path expression relative to the
+// host directory the system's nix file is written to.
+func (s System) NixFiles() map[string]string {
+	files := make(map[string]string, len(s.Files))
+	for target, src := range s.Files {
+		if filepath.IsAbs(src) {
+			files[target] = src
+		} else {
+			files[target] = "../" + filepath.ToSlash(filepath.Clean(src))
+		}
+	}
+	return files
+}
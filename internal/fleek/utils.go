@@ -4,7 +4,11 @@
 package fleek
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -59,3 +63,62 @@ func FileContains(path string, substring string) (bool, error) {
 func Move(oldPath, newPath string) error {
 	return os.Rename(oldPath, newPath)
 }
+
+// ErrNotSymlink is returned by ForceSymlink when the link
+// path exists and isn't a symbolic link.
+var ErrNotSymlink = errors.New("refusing to replace a file that isn't a symlink")
+
+// ForceSymlink creates link as a symbolic link to target.
+// An existing symlink at link is replaced, whether it points
+// elsewhere or is broken, so calling it again is harmless. A
+// regular file or directory at link is never removed.
+func ForceSymlink(target, link string) error {
+	info, err := os.Lstat(link)
+	if err == nil {
+		if info.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("%w: %s", ErrNotSymlink, link)
+		}
+		if current, err := os.Readlink(link); err == nil && current == target {
+			return nil
+		}
+		err = os.Remove(link)
+		if err != nil {
+			return err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Symlink(target, link)
+}
+
+// IsSubmodule reports whether dir is the work tree of a git
+// submodule, which has a `.git` file pointing into the parent
+// repository's `modules` directory. Worktrees also have a
+// `.git` file, pointing into `worktrees` instead.
+func IsSubmodule(dir string) bool {
+	bb, err := os.ReadFile(filepath.Join(dir, ".git"))
+	if err != nil {
+		return false
+	}
+	gitdir, ok := strings.CutPrefix(strings.TrimSpace(string(bb)), "gitdir:")
+	if !ok {
+		return false
+	}
+	return strings.Contains(filepath.ToSlash(strings.TrimSpace(gitdir))+"/", "/modules/")
+}
+
+// InsideGitRepo reports whether dir or any of its parents
+// is the work tree of a git repository.
+func InsideGitRepo(dir string) bool {
+	dir = filepath.Clean(dir)
+	for {
+		if Exists(filepath.Join(dir, ".git")) {
+			return true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+}
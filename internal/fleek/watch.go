@@ -0,0 +1,82 @@
+package fleek
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/ublue-os/fleek/fin"
+)
+
+// WatchInterval is how often Watch checks the
+// configuration file for changes.
+var WatchInterval = 500 * time.Millisecond
+
+// WatchDebounce is how long the configuration file must be
+// unchanged before Watch reloads it, so that an editor
+// saving in several steps only triggers one reload.
+var WatchDebounce = 300 * time.Millisecond
+
+// Watch polls the configuration file the config was read
+// from and calls onChange with the reloaded configuration
+// each time it changes, until ctx is done. Errors from
+// reloading or from onChange are logged and the watch
+// continues. Watch returns ctx.Err() when it stops.
+func (c *Config) Watch(ctx context.Context, onChange func(*Config) error) error {
+	path := c.location
+	if path == "" {
+		var err error
+		path, err = c.Location()
+		if err != nil {
+			return err
+		}
+	}
+	last, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(WatchInterval)
+	defer ticker.Stop()
+	var changed time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			// the file may be mid-save, check again next tick
+			continue
+		}
+		if !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size() {
+			last = info
+			changed = time.Now()
+			continue
+		}
+		if changed.IsZero() || time.Since(changed) < WatchDebounce {
+			continue
+		}
+		changed = time.Time{}
+		fin.Logger.Debug("configuration changed", fin.Logger.Args("file", path))
+		reloaded, err := reloadConfig(path)
+		if err != nil {
+			fin.Logger.Error("reloading configuration", fin.Logger.Args("error", err))
+			continue
+		}
+		err = onChange(reloaded)
+		if err != nil {
+			fin.Logger.Error("configuration change", fin.Logger.Args("error", err))
+		}
+	}
+}
+
+// reloadConfig reads the configuration file at path
+// and resolves its Base configuration.
+func reloadConfig(path string) (*Config, error) {
+	c, err := readConfigFile(path, false)
+	if err != nil || c.Base == "" {
+		return c, err
+	}
+	return c.ResolveConfig()
+}
@@ -46,10 +46,11 @@ func eject(cmd *cobra.Command) error {
 		fl.Config.Aliases["apply-"+system.Hostname] = fmt.Sprintf("nix run --impure home-manager/master -- -b bak switch --flake .#%s@%s", system.Username, system.Hostname)
 		//fin.Info.Printfln("nix run --impure home-manager/master -- -b bak switch --flake .#%s@%s", system.Username, system.Hostname)
 	}
-	err = fl.Config.Save()
+	backup, err := fl.Config.Eject()
 	if err != nil {
 		return err
 	}
+	fin.Logger.Info("backed up generated flake", fin.Logger.Args("dir", backup))
 	// reload config so it won't git push
 	err = fl.ReadConfig(fl.Config.UserFlakeDir())
 	if err != nil {
@@ -10,7 +10,6 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/ublue-os/fleek/fin"
 	"github.com/ublue-os/fleek/internal/flake"
-	"github.com/ublue-os/fleek/internal/fleek"
 )
 
 func InfoCommand() *cobra.Command {
@@ -39,22 +38,8 @@ func infoFleek(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	var b *fleek.Bling
-
-	switch fl.Config.Bling {
-	case "high":
-		b, err = fleek.HighBling()
-		cobra.CheckErr(err)
-	case "default":
-		b, err = fleek.DefaultBling()
-		cobra.CheckErr(err)
-	case "low":
-		b, err = fleek.LowBling()
-		cobra.CheckErr(err)
-	case "none":
-		b, err = fleek.NoBling()
-		cobra.CheckErr(err)
-	}
+	b, err := fl.Config.CurrentBling()
+	cobra.CheckErr(err)
 	fin.Logger.Info("Bling", fin.Logger.Args("Level", b.Name, "Description", b.Description))
 
 	needle := args[0]
@@ -95,10 +95,12 @@ func join(cmd *cobra.Command, args []string) error {
 			return err
 		}
 		csym := filepath.Join(home, ".fleek.yml")
-		err = os.Symlink(cfile, csym)
-		if err != nil {
-			fin.Logger.Debug("symlink  failed")
-			return err
+		if _, override := fleek.ConfigOverride(); !override {
+			err = fleek.ForceSymlink(cfile, csym)
+			if err != nil {
+				fin.Logger.Debug("symlink  failed")
+				return err
+			}
 		}
 		err = fl.Write("update host and user files", true, false)
 		if err != nil {
@@ -51,6 +51,12 @@ func RootCmd() *cobra.Command {
 			// try to get the config, which may not exist yet
 			c, err := fleek.ReadConfig(flags.location)
 			if err == nil {
+				if mismatch := c.FlakeDirMismatch(); mismatch != nil {
+					fin.Logger.Warn(app.Trans("fleek.flakeDirMismatch"), fin.Logger.Args("error", mismatch))
+				}
+				for _, warning := range c.Warnings() {
+					fin.Logger.Warn(warning)
+				}
 
 				fin.Logger.Debug(app.Trans("fleek.configLoaded"), fin.Logger.Args("location", flags.location))
 
@@ -74,6 +80,8 @@ func RootCmd() *cobra.Command {
 						fin.Logger.Error(app.Trans("eject.ejected"))
 						os.Exit(1)
 					}
+				} else if cwd, err := os.Getwd(); cfgFound && err == nil && cfg.InsideFlakeDir(cwd) {
+					fin.Logger.Warn(app.Trans("fleek.insideFlakeDir"), fin.Logger.Args("directory", cfg.UserFlakeDir()))
 				}
 
 				migrate := cfg.NeedsMigration()
@@ -160,8 +168,12 @@ func RootCmd() *cobra.Command {
 
 	infoCmd := InfoCommand()
 	infoCmd.GroupID = packageGroup.ID
+	statsCmd := StatsCommand()
+	statsCmd.GroupID = fleekGroup.ID
 	writeCmd := WriteCommand()
 	writeCmd.GroupID = fleekGroup.ID
+	schemaCmd := SchemaCommand()
+	schemaCmd.GroupID = fleekGroup.ID
 	manCmd := ManCommand()
 
 	docsCmd := genDocsCmd()
@@ -181,7 +193,9 @@ func RootCmd() *cobra.Command {
 	command.AddCommand(searchCmd)
 	command.AddCommand(infoCmd)
 	command.AddCommand(generateCmd)
+	command.AddCommand(statsCmd)
 	command.AddCommand(writeCmd)
+	command.AddCommand(schemaCmd)
 	command.AddCommand(VersionCmd())
 
 	command.PersistentFlags().BoolVarP(
@@ -0,0 +1,23 @@
+package fleekcli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/ublue-os/fleek/internal/fleek"
+)
+
+func SchemaCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:     app.Trans("schema.use"),
+		Short:   app.Trans("schema.short"),
+		Long:    app.Trans("schema.long"),
+		Example: app.Trans("schema.example"),
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fmt.Println(string(fleek.ConfigJSONSchema()))
+			return nil
+		},
+	}
+	return command
+}
@@ -0,0 +1,57 @@
+package fleekcli
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+	"github.com/ublue-os/fleek/fin"
+)
+
+type statsCmdFlags struct {
+	json bool
+}
+
+func StatsCommand() *cobra.Command {
+	flags := statsCmdFlags{}
+	command := &cobra.Command{
+		Use:     app.Trans("stats.use"),
+		Short:   app.Trans("stats.short"),
+		Long:    app.Trans("stats.long"),
+		Example: app.Trans("stats.example"),
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return stats(cmd, flags)
+		},
+	}
+	command.Flags().BoolVarP(
+		&flags.json, app.Trans("stats.jsonFlag"), "j", false, app.Trans("stats.jsonFlagDescription"))
+	return command
+}
+
+func stats(cmd *cobra.Command, flags statsCmdFlags) error {
+	err := mustConfig()
+	if err != nil {
+		return err
+	}
+	s := cfg.Stats()
+	if flags.json {
+		bb, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bb))
+		return nil
+	}
+	fin.Description.Println(cmd.Short)
+	td := pterm.TableData{
+		{app.Trans("stats.packages"), fmt.Sprint(s.Packages)},
+		{app.Trans("stats.programs"), fmt.Sprint(s.Programs)},
+		{app.Trans("stats.aliases"), fmt.Sprint(s.Aliases)},
+		{app.Trans("stats.paths"), fmt.Sprint(s.Paths)},
+		{app.Trans("stats.systems"), fmt.Sprint(s.Systems)},
+		{app.Trans("stats.effectivePackages"), fmt.Sprint(s.EffectivePackages)},
+	}
+	return fin.Table().WithData(td).Render()
+}